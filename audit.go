@@ -0,0 +1,77 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// how long to wait on another run holding the audit log, and how old a lock has to be before it's assumed to
+// have been left behind by a run that died
+const (
+	auditLockWait  = 5 * time.Second
+	auditLockStale = 30 * time.Second
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// appendAuditLog adds one CSV row per run to audit_log_file, for studios that have to keep a record of every
+// decision the trigger made:
+//
+//	timestamp,changelist,user,client,allowed,problems_count,bypass_used
+//
+// a busy server runs several triggers at once, so writes are serialised with a <file>.lock sidecar, created
+// exclusively; there's no portable file locking in the standard library and the sidecar works the same on
+// windows and linux. the limitation is that a run killed while holding the lock leaves it behind - it is taken
+// over once it's older than auditLockStale, which a live run never holds it for
+func appendAuditLog(path string, report AppReport, allowed bool) error {
+
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(auditLockWait)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			lockFile.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if lockInfo, statErr := os.Stat(lockPath); statErr == nil && time.Since(lockInfo.ModTime()) > auditLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer os.Remove(lockPath)
+
+	auditFile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer auditFile.Close()
+
+	writer := csv.NewWriter(auditFile)
+	writer.Write([]string{
+		time.Now().UTC().Format(time.RFC3339),
+		strconv.Itoa(report.Changelist),
+		report.User,
+		report.Client,
+		strconv.FormatBool(allowed),
+		strconv.Itoa(len(report.ProblemsFound)),
+		strconv.FormatBool(report.Bypassed),
+	})
+	writer.Flush()
+	return writer.Error()
+}
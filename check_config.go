@@ -0,0 +1,82 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// checkConfig backs `p4unity check-config`, for trying out a new config before it goes live as the trigger;
+// loading it has already caught parse errors, unknown keys and missing settings by the time we get here. this
+// prints the effective settings (secrets redacted), checks the server answers, then asks `p4 dirs` about each
+// path_whitelist entry - one that matches nothing in the depot is almost certainly a typo, and means the trigger
+// would quietly check nothing there, but it's reported as a warning as the depot may just not have it yet
+func checkConfig(ctx context.Context, runner P4Runner, configPath string) int {
+
+	valid := true
+	report := func(status string, check string, detail string) {
+		if status == "FAIL" {
+			valid = false
+		}
+		fmt.Fprintf(output, "  %-5s %-8s %s\n", status, check, detail)
+	}
+
+	errMsg("config check\n")
+	report("OK", "config", configPath)
+
+	AppConfig.eachSetting(func(key string, value interface{}) {
+		fmt.Fprintf(output, "          %s = %v\n", key, value)
+	})
+
+	// same check as `health`; with no server there's no point asking it about paths
+	infoCtx, cancel := context.WithTimeout(ctx, p4ConnectivityTimeout)
+	infoOut, err := runner.Info(infoCtx)
+	cancel()
+	infoOutString := string(infoOut)
+	if err != nil || !strings.HasPrefix(infoOutString, "info:") {
+		report("FAIL", "server", fmt.Sprintf("%s; %s", AppConfig.P4Port(), strings.TrimSpace(infoOutString)))
+	} else {
+		report("OK", "server", AppConfig.P4Port())
+
+		for _, entry := range AppConfig.PathWhitelist {
+			// an entry without a trailing '/' can stop part-way through a name, so it's asked about as a wildcard
+			dirsSpec := normalizePath(entry)
+			if dirsSpec == "" {
+				dirsSpec = "//*"
+			} else if !strings.HasSuffix(entry, "/") {
+				dirsSpec += "*"
+			}
+
+			dirsOut, _ := runner.Dirs(ctx, dirsSpec)
+			matched, dirsDetail := false, ""
+			for _, line := range strings.Split(string(dirsOut), "\n") {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "info:") {
+					matched = true
+				} else if strings.HasPrefix(line, "error:") && dirsDetail == "" {
+					dirsDetail = strings.TrimSpace(strings.TrimPrefix(line, "error:"))
+				}
+			}
+			if matched {
+				report("OK", "path", entry)
+			} else {
+				report("WARN", "path", fmt.Sprintf("%s matches no depot paths; %s", entry, dirsDetail))
+			}
+		}
+	}
+
+	if !valid {
+		errMsg("FAIL\n")
+		return p4ExitErrorException
+	}
+	errMsg("OK\n")
+	return p4ExitSuccess
+}
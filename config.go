@@ -8,47 +8,401 @@ package main
  */
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
 type tomlConfig struct {
-	VerboseLogs     bool     `toml:"verbose_logs" env:"P4U_VERBOSE"`
-	CaseSensitive   bool     `toml:"case_sensitive" env:"P4U_CASE_SENSITIVE"`
-	PerforceServer  string   `toml:"perforce_server" env:"P4U_SERVER"`
-	PerforceUser    string   `toml:"perforce_user" env:"P4U_USER"`
-	PerforcePass    string   `toml:"perforce_pass" env:"P4U_PASS"`
-	BypassKeyphrase string   `toml:"bypass_keyphrase" env:"P4U_BYPASS"`
-	PathWhitelist   []string `toml:"path_whitelist"`
+	VerboseLogs                     bool              `toml:"verbose_logs" yaml:"verbose_logs" env:"P4U_VERBOSE"`
+	VerboseLogRetentionDays         int               `toml:"verbose_log_retention_days" yaml:"verbose_log_retention_days" env:"P4U_LOG_RETENTION"`
+	VerboseLogDir                   string            `toml:"verbose_log_dir" yaml:"verbose_log_dir" env:"P4U_LOG_DIR"`
+	VerboseLogTimestamp             bool              `toml:"verbose_log_timestamp" yaml:"verbose_log_timestamp" env:"P4U_LOG_TIMESTAMP"`
+	LogLevel                        string            `toml:"log_level" yaml:"log_level" env:"P4U_LOG_LEVEL"`
+	CaseSensitiveDepot              bool              `toml:"case_sensitive" yaml:"case_sensitive" env:"P4U_CASE_SENSITIVE"`
+	PerforceServer                  string            `toml:"perforce_server" yaml:"perforce_server" env:"P4U_SERVER"`
+	PerforceProxy                   string            `toml:"perforce_proxy" yaml:"perforce_proxy" env:"P4U_PROXY"`
+	PerforceUser                    string            `toml:"perforce_user" yaml:"perforce_user" env:"P4U_USER"`
+	PerforcePass                    string            `toml:"perforce_pass" yaml:"perforce_pass" env:"P4U_PASS" redact:"true"`
+	PerforcePassFile                string            `toml:"perforce_pass_file" yaml:"perforce_pass_file" env:"P4U_PASS_FILE"`
+	PerforceTicketFile              string            `toml:"perforce_ticket_file" yaml:"perforce_ticket_file" env:"P4U_TICKET_FILE"`
+	PerforceCharset                 string            `toml:"perforce_charset" yaml:"perforce_charset" env:"P4U_CHARSET"`
+	PerforceTrustFile               string            `toml:"perforce_trust_file" yaml:"perforce_trust_file" env:"P4U_TRUST_FILE"`
+	PerforceSSLDir                  string            `toml:"perforce_ssl_dir" yaml:"perforce_ssl_dir" env:"P4U_SSL_DIR"`
+	PerforceSSL                     bool              `toml:"-" yaml:"-"` // set from the port's ssl: prefix once loaded, see parseP4Port
+	UseZtagOutput                   bool              `toml:"use_ztag_output" yaml:"use_ztag_output" env:"P4U_ZTAG"`
+	CheckOpenedFiles                bool              `toml:"check_opened_files" yaml:"check_opened_files" env:"P4U_CHECK_OPENED"`
+	ValidateCredentialsOnStart      bool              `toml:"validate_credentials_on_start" yaml:"validate_credentials_on_start" env:"P4U_VALIDATE_CREDS"`
+	ConnectionRetryCount            int               `toml:"connection_retry_count" yaml:"connection_retry_count" env:"P4U_RETRY_COUNT"`
+	ConnectionRetryDelayMs          int               `toml:"connection_retry_delay_ms" yaml:"connection_retry_delay_ms" env:"P4U_RETRY_DELAY"`
+	OverallTimeoutSeconds           int               `toml:"overall_timeout_seconds" yaml:"overall_timeout_seconds" env:"P4U_TIMEOUT"`
+	DescribeTimeoutSeconds          int               `toml:"describe_timeout_seconds" yaml:"describe_timeout_seconds" env:"P4U_DESCRIBE_TIMEOUT"`
+	FstatTimeoutSeconds             int               `toml:"fstat_timeout_seconds" yaml:"fstat_timeout_seconds" env:"P4U_FSTAT_TIMEOUT"`
+	FstatFields                     string            `toml:"fstat_fields" yaml:"fstat_fields" env:"P4U_FSTAT_FIELDS"`
+	SkipFstatOnAdd                  bool              `toml:"skip_fstat_on_add" yaml:"skip_fstat_on_add" env:"P4U_SKIP_FSTAT_ADD"`
+	SkipFstatOnDelete               bool              `toml:"skip_fstat_on_delete" yaml:"skip_fstat_on_delete" env:"P4U_SKIP_FSTAT_DEL"`
+	BypassKeyphrase                 string            `toml:"bypass_keyphrase" yaml:"bypass_keyphrase" env:"P4U_BYPASS" redact:"true"`
+	BypassKeyPhrases                []string          `toml:"bypass_keyphrases" yaml:"bypass_keyphrases" env:"P4U_BYPASS_LIST" sep:"," redact:"true"`
+	BypassKeyPhraseRegex            string            `toml:"bypass_keyphrase_regex" yaml:"bypass_keyphrase_regex" env:"P4U_BYPASS_REGEX"`
+	BypassHMACSecret                string            `toml:"bypass_hmac_secret" yaml:"bypass_hmac_secret" env:"P4U_HMAC_SECRET" redact:"true"`
+	BypassHMACWindowMinutes         int               `toml:"bypass_hmac_window_minutes" yaml:"bypass_hmac_window_minutes" env:"P4U_HMAC_WINDOW"`
+	BypassUsers                     []string          `toml:"bypass_users" yaml:"bypass_users" env:"P4U_BYPASS_USERS" sep:","`
+	RequiredGroups                  []string          `toml:"required_groups" yaml:"required_groups" env:"P4U_GROUPS" sep:","`
+	PathWhitelist                   []string          `toml:"path_whitelist" yaml:"path_whitelist" env:"P4U_WHITELIST" sep:"pathlist"`
+	PathWhitelistCaseSensitive      bool              `toml:"path_whitelist_case_sensitive" yaml:"path_whitelist_case_sensitive" env:"P4U_WHITELIST_CASE"`
+	PathWhitelistFile               string            `toml:"path_whitelist_file" yaml:"path_whitelist_file" env:"P4U_WHITELIST_FILE"`
+	PathWhitelistRegex              []string          `toml:"path_whitelist_regex" yaml:"path_whitelist_regex"`
+	LabelWhitelist                  []string          `toml:"label_whitelist" yaml:"label_whitelist" env:"P4U_LABELS" sep:","`
+	PreloadLabels                   bool              `toml:"preload_labels" yaml:"preload_labels" env:"P4U_PRELOAD_LABELS"`
+	PathBlacklist                   []string          `toml:"path_blacklist" yaml:"path_blacklist" env:"P4U_BLACKLIST" sep:"pathlist"`
+	PathBypassRules                 map[string]string `toml:"path_bypass_rules" yaml:"path_bypass_rules"`
+	AssetsFolderPatterns            []string          `toml:"assets_folder_patterns" yaml:"assets_folder_patterns" env:"P4U_ASSETS_PATTERNS" sep:"pathlist"`
+	PackagesFolderPatterns          []string          `toml:"packages_folder_patterns" yaml:"packages_folder_patterns" env:"P4U_PACKAGES_PATTERNS" sep:"pathlist"`
+	PackagesWarnOnly                bool              `toml:"packages_warn_only" yaml:"packages_warn_only" env:"P4U_PACKAGES_WARN_ONLY"`
+	IgnoredDirectoryPatterns        []string          `toml:"ignored_directory_patterns" yaml:"ignored_directory_patterns" env:"P4U_IGNORED_DIRS" sep:"pathlist"`
+	DotFileExclusions               []string          `toml:"dot_file_exclusions" yaml:"dot_file_exclusions" env:"P4U_DOT_EXCLUSIONS"`
+	IgnoredExtensions               []string          `toml:"ignored_extensions" yaml:"ignored_extensions" env:"P4U_IGNORE_EXT"`
+	AssetExtensionRequiresMeta      []string          `toml:"asset_extensions_requiring_meta" yaml:"asset_extensions_requiring_meta" env:"P4U_META_EXTENSIONS"`
+	AssetExtensionNeverRequiresMeta []string          `toml:"asset_extensions_never_requiring_meta" yaml:"asset_extensions_never_requiring_meta" env:"P4U_NO_META_EXTENSIONS"`
+	WorkerCount                     int               `toml:"worker_count" yaml:"worker_count" env:"P4U_WORKERS"`
+	ValidateMetaGUID                bool              `toml:"validate_meta_guid" yaml:"validate_meta_guid" env:"P4U_VALIDATE_GUID"`
+	ValidateMetaSize                bool              `toml:"validate_meta_size" yaml:"validate_meta_size" env:"P4U_VALIDATE_META_SIZE"`
+	RequireConsistentGUID           bool              `toml:"require_consistent_guid" yaml:"require_consistent_guid" env:"P4U_CONSISTENT_GUID"`
+	RequireMetaForDirectories       bool              `toml:"require_meta_for_directories" yaml:"require_meta_for_directories" env:"P4U_DIR_META"`
+	JSONOutput                      bool              `toml:"json_output" yaml:"json_output" env:"P4U_JSON"`
+	MarkdownOutput                  bool              `toml:"markdown_output" yaml:"markdown_output" env:"P4U_MARKDOWN"`
+	XMLReportFile                   string            `toml:"xml_report_file" yaml:"xml_report_file" env:"P4U_XML_REPORT"`
+	OutputFile                      string            `toml:"output_file" yaml:"output_file" env:"P4U_OUTPUT_FILE"`
+	AuditLogFile                    string            `toml:"audit_log_file" yaml:"audit_log_file" env:"P4U_AUDIT_LOG"`
+	WarnOnly                        bool              `toml:"warn_only" yaml:"warn_only" env:"P4U_WARNONLY"`
+	Simulate                        bool              `toml:"simulate" yaml:"simulate" env:"P4U_SIMULATE"`
+	StrictMode                      bool              `toml:"strict_mode" yaml:"strict_mode" env:"P4U_STRICT"`
+	ErrorPrefix                     string            `toml:"error_prefix" yaml:"error_prefix" env:"P4U_PREFIX"`
+	IncludeChangeDescription        bool              `toml:"include_change_description" yaml:"include_change_description" env:"P4U_INCLUDE_DESC"`
+	DescriptionMaxLines             int               `toml:"description_max_lines" yaml:"description_max_lines" env:"P4U_DESC_MAX_LINES"`
+	MaxValidationErrors             int               `toml:"max_validation_errors" yaml:"max_validation_errors" env:"P4U_MAX_ERRORS"`
+	MaxFilesPerChangelist           int               `toml:"max_files_per_changelist" yaml:"max_files_per_changelist" env:"P4U_MAX_FILES"`
+	ReportWebhookURL                string            `toml:"report_webhook_url" yaml:"report_webhook_url" env:"P4U_WEBHOOK_URL" redact:"true"`
+	WebhookTimeoutSeconds           int               `toml:"webhook_timeout_seconds" yaml:"webhook_timeout_seconds" env:"P4U_WEBHOOK_TIMEOUT"`
+	StatsCounterPrefix              string            `toml:"stats_counter_prefix" yaml:"stats_counter_prefix" env:"P4U_STATS_PREFIX"`
 }
 
 // AppConfig is the config data parsed from disk
 var AppConfig tomlConfig
 
-// LoadConfig fetches current settings from the toml file on disk
-func LoadConfig() {
+// compiledWhitelistRegex holds the compiled form of AppConfig.PathWhitelistRegex
+var compiledWhitelistRegex []*regexp.Regexp
 
-	configFilename := "p4unity.toml"
+// compiledBypassRegex holds the compiled form of AppConfig.BypassKeyPhraseRegex, or nil if there isn't one
+var compiledBypassRegex *regexp.Regexp
+
+// configDefaults is applied before decoding, so anything not set in the toml keeps these values
+var configDefaults = tomlConfig{
+	VerboseLogDir:              "p4unity_logs",
+	LogLevel:                   "info",
+	AssetsFolderPatterns:       []string{"/Assets/"},
+	IgnoredDirectoryPatterns:   []string{"~/"},
+	DotFileExclusions:          []string{"."},
+	IgnoredExtensions:          []string{".DS_Store", ".db"},
+	ErrorPrefix:                "[p4unity]",
+	WorkerCount:                4,
+	ConnectionRetryCount:       3,
+	ConnectionRetryDelayMs:     500,
+	OverallTimeoutSeconds:      30,
+	DescribeTimeoutSeconds:     15,
+	FstatTimeoutSeconds:        10,
+	FstatFields:                "headAction",
+	WebhookTimeoutSeconds:      5,
+	DescriptionMaxLines:        5,
+	BypassHMACWindowMinutes:    60,
+	PathWhitelistCaseSensitive: true,
+	PackagesWarnOnly:           true,
+}
+
+// BypassPhrases returns every non-empty bypass keyphrase; the legacy single `bypass_keyphrase`
+// is honoured alongside the `bypass_keyphrases` list
+func (cfg *tomlConfig) BypassPhrases() []string {
+	phrases := make([]string, 0, len(cfg.BypassKeyPhrases)+1)
+	if cfg.BypassKeyphrase != "" {
+		phrases = append(phrases, cfg.BypassKeyphrase)
+	}
+	for _, phrase := range cfg.BypassKeyPhrases {
+		if phrase != "" {
+			phrases = append(phrases, phrase)
+		}
+	}
+	return phrases
+}
+
+// P4Port returns the address p4 commands should connect to; the proxy if one is configured, so the
+// documented server address can stay as it is while traffic is routed through p4p
+func (cfg *tomlConfig) P4Port() string {
+	if cfg.PerforceProxy != "" {
+		return cfg.PerforceProxy
+	}
+	return cfg.PerforceServer
+}
+
+// parseP4Port splits a P4PORT-style address into its parts the way p4 reads it: an optional protocol in front (eg.
+// "ssl:", "tcp6:", "rsh:"), then host:port - or just a port, on the local host, when there's no host. nothing is
+// rejected here, p4 is left to judge the address; this is only for finding out whether ssl is in play. an rsh:
+// address is a command line rather than host:port, and comes back whole as the port
+func parseP4Port(raw string) (host, port string, ssl bool) {
+
+	address := raw
+	if protocolEnd := strings.Index(address, ":"); protocolEnd >= 0 {
+		switch strings.ToLower(address[:protocolEnd]) {
+		case "ssl", "ssl4", "ssl6", "ssl46", "ssl64":
+			ssl = true
+			address = address[protocolEnd+1:]
+		case "tcp", "tcp4", "tcp6", "tcp46", "tcp64", "udt":
+			address = address[protocolEnd+1:]
+		case "rsh", "jsh":
+			return "", address[protocolEnd+1:], false
+		}
+	}
+
+	// the port is always last; splitting on the final ':' leaves a bracketed ipv6 host, eg. [::1], intact
+	portStart := strings.LastIndex(address, ":")
+	if portStart < 0 {
+		return "", address, ssl
+	}
+	return address[:portStart], address[portStart+1:], ssl
+}
+
+// eachSetting calls <fn> with the toml key and value of every setting, in declaration order; secrets (tagged
+// redact) come through as "***" if they're set at all
+func (cfg *tomlConfig) eachSetting(fn func(key string, value interface{})) {
+
+	configValue := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		fieldType := configValue.Type().Field(i)
+		field := configValue.Field(i)
+		if fieldType.Tag.Get("toml") == "-" {
+			continue
+		}
+		if fieldType.Tag.Get("redact") == "true" && !field.IsZero() {
+			fn(fieldType.Tag.Get("toml"), "***")
+		} else {
+			fn(fieldType.Tag.Get("toml"), field.Interface())
+		}
+	}
+}
+
+// LogFields describes every setting for the verbose log, so it's clear what a deployed binary is actually running
+// with; secrets are redacted by eachSetting
+func (cfg *tomlConfig) LogFields() []zap.Field {
+
+	fields := make([]zap.Field, 0)
+	cfg.eachSetting(func(key string, value interface{}) {
+		fields = append(fields, zap.Any(key, value))
+	})
+	return fields
+}
+
+// defaultConfigFilename is loaded from the working directory (next to p4d, when run as a trigger) if nothing else is specified
+const defaultConfigFilename = "p4unity.toml"
+
+// ConfigPath picks which config file to load; an explicit path (eg. from the command line) wins,
+// then the P4U_CONFIG envvar, then the default filename
+func ConfigPath(explicitPath string) string {
+	if explicitPath != "" {
+		return explicitPath
+	}
+	if envPath := os.Getenv("P4U_CONFIG"); envPath != "" {
+		return envPath
+	}
+	return defaultConfigFilename
+}
+
+// LoadConfig fetches current settings from the config file on disk; toml, unless the extension says it's yaml
+func LoadConfig(configFilename string) {
+
+	switch strings.ToLower(filepath.Ext(configFilename)) {
+	case ".yaml", ".yml":
+		LoadConfigYAML(configFilename)
+		return
+	}
 
 	cfgBytes, err := ioutil.ReadFile(configFilename)
 	if err != nil {
-		log.Panicf("[p4unity:config] p4unity.toml not found - %s", err)
+		fatalConfig("%s not found - %s", configFilename, err)
 	}
 
 	// parse and map the data onto the structs
-	if _, err := toml.Decode(string(cfgBytes), &AppConfig); err != nil {
-		log.Panicf("[p4unity:config] Decode failure - %s", err)
+	AppConfig = configDefaults
+	meta, err := toml.Decode(string(cfgBytes), &AppConfig)
+	if err != nil {
+		fatalConfig("decode failure - %s", err)
+	}
+
+	// a misspelt key would otherwise be skipped without a word, leaving its setting at the default
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		unknownKeys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			unknownKeys = append(unknownKeys, key.String())
+		}
+		fatalConfig("unknown key(s) in %s - %s; check the spelling against the keys in the p4unity.toml template", configFilename, strings.Join(unknownKeys, ", "))
+	}
+
+	finishLoadingConfig()
+}
+
+// LoadConfigYAML fetches current settings from a yaml file on disk, for teams that would rather not keep
+// a toml file next to the rest of their yaml; keys are the same as in the toml
+func LoadConfigYAML(configFilename string) {
+
+	cfgBytes, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		fatalConfig("%s not found - %s", configFilename, err)
 	}
 
+	// as with the toml, an unknown (probably misspelt) key is an error rather than silently ignored
+	AppConfig = configDefaults
+	decoder := yaml.NewDecoder(bytes.NewReader(cfgBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&AppConfig); err != nil && err != io.EOF {
+		fatalConfig("decode failure - %s", err)
+	}
+
+	finishLoadingConfig()
+}
+
+// fatalConfig reports a config problem as a single line on stderr and exits; p4 relays what the trigger printed
+// to whoever was submitting, and a panic's stack trace would only bury the message
+func fatalConfig(format string, args ...interface{}) {
+	prefix := AppConfig.ErrorPrefix
+	if prefix == "" {
+		prefix = configDefaults.ErrorPrefix
+	}
+	fmt.Fprintf(os.Stderr, "%s config: %s\n", prefix, fmt.Sprintf(format, args...))
+	os.Exit(p4ExitErrorException)
+}
+
+// finishLoadingConfig applies envvar overrides and checks the result, whichever format it was loaded from
+func finishLoadingConfig() {
+
 	// loop throught the config fields; anything with an 'env' tag allows for override with envvars
-	if err = checkOverrides(&AppConfig); err != nil {
-		log.Panicf("[p4unity:config] Override failure - %s", err)
+	if err := checkOverrides(&AppConfig); err != nil {
+		fatalConfig("override failure - %s", err)
+	}
+
+	// a long list of depot roots can be kept in a file of its own, one per line; combined with any in the config
+	if AppConfig.PathWhitelistFile != "" {
+		whitelistBytes, err := ioutil.ReadFile(AppConfig.PathWhitelistFile)
+		if err != nil {
+			fatalConfig("path_whitelist_file %s not found - %s", AppConfig.PathWhitelistFile, err)
+		}
+		for _, entry := range strings.Split(string(whitelistBytes), "\n") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			AppConfig.PathWhitelist = append(AppConfig.PathWhitelist, entry)
+		}
+	}
+
+	if err := validateConfig(&AppConfig); err != nil {
+		fatalConfig("%s", err)
 	}
+
+	// the address actually used, proxy or server, decides whether ssl is in play
+	_, _, AppConfig.PerforceSSL = parseP4Port(AppConfig.P4Port())
+
+	// compile the whitelist regexes once, up front, rather than per file
+	compiledWhitelistRegex = make([]*regexp.Regexp, 0, len(AppConfig.PathWhitelistRegex))
+	for _, pattern := range AppConfig.PathWhitelistRegex {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			fatalConfig("path_whitelist_regex '%s' is invalid - %s", pattern, err)
+		}
+		compiledWhitelistRegex = append(compiledWhitelistRegex, compiled)
+	}
+
+	compiledBypassRegex = nil
+	if AppConfig.BypassKeyPhraseRegex != "" {
+		compiled, err := regexp.Compile(AppConfig.BypassKeyPhraseRegex)
+		if err != nil {
+			fatalConfig("bypass_keyphrase_regex '%s' is invalid - %s", AppConfig.BypassKeyPhraseRegex, err)
+		}
+		compiledBypassRegex = compiled
+	}
+}
+
+// listSeparator picks the delimiter used to split a list envvar; <envvar>_SEP can override it outright (eg. P4U_WHITELIST_SEP),
+// otherwise the 'sep' tag is used - with "pathlist" meaning the OS list separator, ':' on Linux and ';' on Windows
+func listSeparator(envOverride string, sepTag string) string {
+	if separator := os.Getenv(envOverride + "_SEP"); separator != "" {
+		return separator
+	}
+	switch sepTag {
+	case "":
+		return ","
+	case "pathlist":
+		return string(os.PathListSeparator)
+	}
+	return sepTag
+}
+
+// parseEnvBool understands the usual sysadmin spellings - yes/no, on/off - as well as everything strconv.ParseBool does
+func parseEnvBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// validateConfig checks the settings we can't do without are present, naming the envvar that can supply them
+func validateConfig(cfg *tomlConfig) error {
+
+	if cfg.PerforceServer == "" {
+		return fmt.Errorf("perforce_server is empty; set it in the config or with P4U_SERVER")
+	}
+	if cfg.PerforceUser == "" {
+		return fmt.Errorf("perforce_user is empty; set it in the config or with P4U_USER")
+	}
+	// a ticket file or password file stands in for the password
+	if cfg.PerforcePass == "" && cfg.PerforceTicketFile == "" && cfg.PerforcePassFile == "" {
+		return fmt.Errorf("perforce_pass is empty; set it in the config or with P4U_PASS (or use perforce_pass_file / P4U_PASS_FILE, or perforce_ticket_file / P4U_TICKET_FILE)")
+	}
+	// the password file is read fresh for every p4 call, but it should at least be there to begin with
+	if cfg.PerforcePassFile != "" {
+		if _, err := os.Stat(cfg.PerforcePassFile); err != nil {
+			return fmt.Errorf("perforce_pass_file '%s' cannot be read - %s", cfg.PerforcePassFile, err)
+		}
+	}
+	if _, err := zap.ParseAtomicLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("log_level '%s' is not a level zap understands (debug, info, warn, error ..)", cfg.LogLevel)
+	}
+	// every label costs a 'p4 files' call on every submit, so that has to be asked for explicitly
+	if len(cfg.LabelWhitelist) > 0 && !cfg.PreloadLabels {
+		return fmt.Errorf("label_whitelist is set but preload_labels is not; labels are loaded with a 'p4 files' call each per run, set preload_labels = true (or P4U_PRELOAD_LABELS) to accept that")
+	}
+
+	// strict mode won't run with settings that quietly turn p4unity into a no-op, or leave no way past it
+	if cfg.StrictMode {
+		if len(cfg.PathWhitelist) == 0 && len(cfg.PathWhitelistRegex) == 0 && len(cfg.LabelWhitelist) == 0 {
+			return fmt.Errorf("strict_mode: path_whitelist is empty, so nothing would ever be checked; use \"//\" to check everything")
+		}
+		if cfg.BypassKeyphrase == "" && len(cfg.BypassKeyPhrases) == 0 && cfg.BypassKeyPhraseRegex == "" && cfg.BypassHMACSecret == "" {
+			return fmt.Errorf("strict_mode: bypass_keyphrase is empty, so a changelist that has to go in as-is never can")
+		}
+	}
+	return nil
 }
 
 func checkOverrides(configData interface{}) error {
@@ -78,6 +432,13 @@ func checkOverrides(configData interface{}) error {
 				case reflect.String:
 					field.Set(reflect.ValueOf(overrideFromEnv))
 
+				case reflect.Int:
+					ivalue, err := strconv.Atoi(overrideFromEnv)
+					if err != nil {
+						return err
+					}
+					field.Set(reflect.ValueOf(ivalue))
+
 				case reflect.Int32:
 					ivalue, err := strconv.ParseInt(overrideFromEnv, 0, 32)
 					if err != nil {
@@ -93,11 +454,25 @@ func checkOverrides(configData interface{}) error {
 					field.Set(reflect.ValueOf(float64(fvalue)))
 
 				case reflect.Bool:
-					bvalue, err := strconv.ParseBool(overrideFromEnv)
+					bvalue, err := parseEnvBool(overrideFromEnv)
 					if err != nil {
 						return err
 					}
 					field.Set(reflect.ValueOf(bvalue))
+
+				case reflect.Slice:
+					// string lists are passed as a single delimited string, eg. "a,b,c"
+					if field.Type().Elem().Kind() == reflect.String {
+						separator := listSeparator(envOverride, fieldType.Tag.Get("sep"))
+						svalue := make([]string, 0)
+						for _, entry := range strings.Split(overrideFromEnv, separator) {
+							entry = strings.TrimSpace(entry)
+							if entry != "" {
+								svalue = append(svalue, entry)
+							}
+						}
+						field.Set(reflect.ValueOf(svalue))
+					}
 				}
 
 			}
@@ -0,0 +1,58 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"testing"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// every P4PORT form p4 takes has to load; only the ssl: prefixes turn ssl on
+
+func TestParseP4Port(t *testing.T) {
+
+	for _, tc := range []struct {
+		raw  string
+		host string
+		port string
+		ssl  bool
+	}{
+		{"1666", "", "1666", false},
+		{"localhost:1666", "localhost", "1666", false},
+		{"ssl:1666", "", "1666", true},
+		{"ssl:perforce.example.com:1666", "perforce.example.com", "1666", true},
+		{"SSL4:perforce:1666", "perforce", "1666", true},
+		{"tcp:perforce:1666", "perforce", "1666", false},
+		{"tcp6:[::1]:1666", "[::1]", "1666", false},
+		{"rsh:p4d -r /p4root -i", "", "p4d -r /p4root -i", false},
+		{"perforce:ssl", "perforce", "ssl", false},
+	} {
+		host, port, ssl := parseP4Port(tc.raw)
+		if host != tc.host || port != tc.port || ssl != tc.ssl {
+			t.Errorf("parseP4Port(%q) = %q, %q, %v; want %q, %q, %v", tc.raw, host, port, ssl, tc.host, tc.port, tc.ssl)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// secrets never show up in the effective config, as logged or listed by check-config
+
+func TestEachSetting_Redacts(t *testing.T) {
+	useTestConfig(t)
+	AppConfig.PerforcePass = "hunter2"
+	AppConfig.ReportWebhookURL = "https://hooks.slack.com/services/T000/B000/secret-token"
+
+	AppConfig.eachSetting(func(key string, value interface{}) {
+		switch key {
+		case "perforce_pass", "report_webhook_url":
+			if value != "***" {
+				t.Errorf("%s = %v, want ***", key, value)
+			}
+		}
+	})
+}
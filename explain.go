@@ -0,0 +1,54 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// explanation is printed by `p4unity -explain`; it needs no config or server, so anyone puzzled by a rejected
+// submit can run it on their own machine
+const explanation = `p4unity checks changelists submitted to Unity projects in Perforce, and rejects those that
+would leave the depot with assets and .meta files out of step.
+
+why .meta files matter
+  Unity writes a .meta file next to every asset and folder under Assets/. it holds the asset's
+  import settings and, crucially, its GUID - scenes, prefabs and materials refer to assets by that
+  GUID, not by path. submit an asset without its .meta and everyone else's Unity generates a new
+  one with a new GUID, silently breaking every reference to it. submit a .meta without its asset
+  (or delete one without the other) and Unity discards or regenerates it, with the same result.
+  see https://docs.unity3d.com/Manual/AssetMetadata.html
+
+what is checked
+  * assets added without their .meta, and .meta files added without their asset
+  * assets or .meta files deleted, or moved, without their counterpart
+  * assets edited whose .meta is no longer in the depot
+  * depending on how p4unity is set up: .meta files with a missing, malformed or changed guid,
+    empty .meta files, and directory .meta files for folders that don't exist
+  only paths the server's config lists are checked; files outside Unity Assets/ folders, inside
+  folders ending in ~, and dotfiles are left alone
+
+fixing a rejected submit
+  add the missing .meta (or asset) to the same changelist - in Unity, make sure the editor has
+  imported the asset so the .meta exists - or revert the file that is missing its counterpart,
+  then submit again. each problem is listed with the depot path it concerns
+
+exit codes
+  0  the changelist is fine, was bypassed, or problems were only reported (dry run / warn only)
+  1  there were problems and the submit was rejected, or p4unity itself could not run
+
+bypassing
+  if a changelist genuinely needs to go in as it is, include the bypass keyphrase configured on
+  the server (ask whoever administers Perforce) anywhere in the changelist description. use it
+  sparingly; every bypass is logged
+`
+
+func printExplanation() {
+	fmt.Fprint(output, explanation)
+}
@@ -0,0 +1,77 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// healthCheck backs `p4unity health`; it exercises everything a real trigger run depends on - the server, the
+// credentials and the log directory - without needing a changelist, and prints an OK/FAIL line for each.
+// the config itself has already been loaded (and validated) by the time we get here
+func healthCheck(ctx context.Context, runner P4Runner, configPath string) int {
+
+	healthy := true
+	report := func(ok bool, check string, detail string) {
+		status := "OK"
+		if !ok {
+			status = "FAIL"
+			healthy = false
+		}
+		fmt.Fprintf(output, "  %-5s %-8s %s\n", status, check, detail)
+	}
+
+	errMsg("health check\n")
+	report(true, "config", configPath)
+
+	// server reachability; p4 info doesn't need a login, so a failure here is the port, network or p4 binary
+	infoCtx, cancel := context.WithTimeout(ctx, p4ConnectivityTimeout)
+	infoOut, err := runner.Info(infoCtx)
+	cancel()
+	infoOutString := string(infoOut)
+	if err != nil || !strings.HasPrefix(infoOutString, "info:") {
+		report(false, "server", fmt.Sprintf("%s; %s", AppConfig.P4Port(), strings.TrimSpace(infoOutString)))
+	} else {
+		serverDetail := AppConfig.P4Port()
+		for _, field := range reP4InfoField.FindAllStringSubmatch(infoOutString, -1) {
+			serverDetail += fmt.Sprintf(", %s: %s", field[1], field[2])
+		}
+		report(true, "server", serverDetail)
+	}
+
+	// authentication
+	loginOut, loginOK := checkP4Login(ctx, runner)
+	report(loginOK, "login", fmt.Sprintf("%s; %s", AppConfig.PerforceUser, loginOut))
+
+	// verbose logs are only useful if we can actually write them
+	logDir := AppConfig.VerboseLogDir
+	if err = os.MkdirAll(logDir, os.ModePerm); err == nil {
+		var probe *os.File
+		if probe, err = ioutil.TempFile(logDir, "health-"); err == nil {
+			probe.Close()
+			os.Remove(probe.Name())
+		}
+	}
+	if err != nil {
+		report(false, "logs", fmt.Sprintf("%s; %s", logDir, err))
+	} else {
+		report(true, "logs", logDir)
+	}
+
+	if !healthy {
+		errMsg("FAIL\n")
+		return p4ExitErrorException
+	}
+	errMsg("OK\n")
+	return p4ExitSuccess
+}
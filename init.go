@@ -0,0 +1,50 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	_ "embed" // for the config template
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// configTemplate is the commented p4unity.toml from the repository, which lists every setting with its default,
+// envvar and what it does; built in so `p4unity init` can hand it to anyone with just the binary
+//
+//go:embed p4unity.toml
+var configTemplate []byte
+
+// ----------------------------------------------------------------------------------------------------------
+// initConfig backs `p4unity init [-write]`; the starter config goes to stdout, or with -write into the current
+// directory - unless there's already a config there, which is never overwritten. runs before any config is loaded
+func initConfig(args []string) int {
+
+	initFlags := flag.NewFlagSet("init", flag.ContinueOnError)
+	writeFlag := initFlags.Bool("write", false, "write "+defaultConfigFilename+" to the current directory instead of stdout")
+	if err := initFlags.Parse(args); err != nil {
+		return p4ExitErrorUsage
+	}
+
+	if !*writeFlag {
+		output.Write(configTemplate)
+		return p4ExitSuccess
+	}
+
+	if _, err := os.Stat(defaultConfigFilename); err == nil {
+		fmt.Fprintf(os.Stderr, "p4unity: %s already exists in this directory; not overwriting it\n", defaultConfigFilename)
+		return p4ExitErrorUsage
+	}
+	if err := ioutil.WriteFile(defaultConfigFilename, configTemplate, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "p4unity: could not write %s; %s\n", defaultConfigFilename, err)
+		return p4ExitErrorException
+	}
+	fmt.Fprintf(output, "wrote %s\n", defaultConfigFilename)
+	return p4ExitSuccess
+}
@@ -8,39 +8,131 @@ package main
  */
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/chilts/sid"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // ----------------------------------------------------------------------------------------------------------
 
 // VerboseLogger produces a zap logger that writes to a new, unique log file for
 // every invocation of p4unity, allowing for very verbose tracking of what's happening. Not intended
-// for day to day use, as there's no log expiration or rotation - it will just sit there slowly filling up
-// next to your P4 server instance
-func VerboseLogger() (*zap.Logger, error) {
+// for day to day use; unless verbose_log_retention_days is set there's no log expiration or rotation - it will
+// just sit there slowly filling up next to your P4 server instance
+//
+// with verbose_log_timestamp set, files are named for when they were made and the changelist being checked,
+// eg. 20240115-103045.123-CL9148.txt, so they sort sensibly; otherwise the name is a random id
+func VerboseLogger(changelistArg string) (*zap.Logger, error) {
+
+	// relative paths resolve from the working directory; when invoked by p4, that is next to p4d/p4s.exe
+	logDir := AppConfig.VerboseLogDir
+	os.MkdirAll(logDir, os.ModePerm)
+
+	logName := sid.IdHex()
+	if AppConfig.VerboseLogTimestamp {
+		logName = time.Now().Format("20060102-150405.000")
+		if changelist, err := strconv.Atoi(changelistArg); err == nil {
+			logName += fmt.Sprintf("-CL%d", changelist)
+		}
+	}
 
-	os.Mkdir("p4unity_logs", os.ModePerm)
+	// per-file decisions are logged at debug, so they only show up if log_level asks for them
+	level, err := zap.ParseAtomicLevel(AppConfig.LogLevel)
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := zap.NewProductionConfig()
+	cfg.Level = level
 	cfg.OutputPaths = []string{
-		fmt.Sprintf("p4unity_logs/%s.txt", sid.IdHex()), // not when invoked by p4, logs appear next to p4d/p4s.exe
+		filepath.Join(logDir, logName+".txt"),
+	}
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if AppConfig.VerboseLogRetentionDays > 0 {
+		expireVerboseLogs(logger, logDir, AppConfig.VerboseLogRetentionDays)
 	}
-	return cfg.Build()
+	return logger, nil
+}
+
+// expireVerboseLogs removes any log files older than <retentionDays> from <logDir>; failures are only warned about,
+// a log that can't be tidied shouldn't get in the way of validating the changelist
+func expireVerboseLogs(logger *zap.Logger, logDir string, retentionDays int) {
+
+	logFiles, err := ioutil.ReadDir(logDir)
+	if err != nil {
+		logger.Warn("LogRetention", zap.String("dir", logDir), zap.Error(err))
+		return
+	}
+
+	expiry := time.Now().AddDate(0, 0, -retentionDays)
+	expired := 0
+	for _, logFile := range logFiles {
+
+		if logFile.IsDir() || !logFile.ModTime().Before(expiry) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(logDir, logFile.Name())); err != nil {
+			logger.Warn("LogRetention", zap.String("file", logFile.Name()), zap.Error(err))
+			continue
+		}
+		expired++
+	}
+
+	logger.Info("LogRetention", zap.Int("days", retentionDays), zap.Int("expired", expired))
 }
 
 var zLog *zap.Logger = nil
 
+// build information, injected at build time; eg.
+//   go build -ldflags "-X main.Version=1.2.3 -X main.BuildDate=2020-04-12 -X main.BuildCommit=abc1234"
+var (
+	Version     = "dev"
+	BuildDate   = "unknown"
+	BuildCommit = "unknown"
+)
+
+// dryRun is a one-shot, invocation-level override (-dry-run or P4U_DRYRUN) that runs every check but never blocks
+var dryRun = false
+
+// describeFile, if set (-describe-file), is read in place of running p4 describe; eg. output saved with
+// 'p4 -G describe -s <CL>', to replay a trigger run or work without a server
+var describeFile = ""
+
+// runByHand is set when p4unity is run from a shell, or replays a saved describe, rather than being fired by p4d as
+// a trigger; p4d runs triggers without a terminal attached
+var runByHand = false
+
+// stdinIsTerminal reports whether someone could be typing at us
+func stdinIsTerminal() bool {
+	stdinInfo, err := os.Stdin.Stat()
+	return err == nil && stdinInfo.Mode()&os.ModeCharDevice != 0
+}
+
 // ----------------------------------------------------------------------------------------------------------
 // custom app exit codes; anything other than 0 will halt the p4 process
 // switching Success to return non-0 can help when testing against a live depot, so you can see the results
@@ -54,23 +146,61 @@ const p4ExitErrorEmpty = 1     // p4 returned empty results when interrogating a
 const p4ExitErrorUsage = 1     // missing arguments
 
 // ----------------------------------------------------------------------------------------------------------
-// simple type wrapper for a string set
+// normalizePath strips trailing slashes, so "//Depot/Project/Assets/" and "//Depot/Project/Assets" are the same
+// thing wherever paths get compared
+//
+func normalizePath(s string) string {
+	return strings.TrimRight(s, "/")
+}
+
+// directoryHasPrefix compares a depot directory against a config entry with both sides normalised; an entry ending
+// in '/' has to match whole folder names, whereas one without can stop part-way through a name, as it always could
+func directoryHasPrefix(depotDirectory string, prefix string) bool {
+	depotDirectory = normalizePath(depotDirectory) + "/"
+	if strings.HasSuffix(prefix, "/") {
+		prefix = normalizePath(prefix) + "/"
+	}
+	return strings.HasPrefix(depotDirectory, prefix)
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// simple type wrapper for a string set; entries are normalised, see normalizePath
 //
 type stringSet map[string]struct{}
 
 func (s stringSet) add(strvalue string) {
-	s[strvalue] = struct{}{}
+	s[normalizePath(strvalue)] = struct{}{}
 }
 
 func (s stringSet) remove(strvalue string) {
-	delete(s, strvalue)
+	delete(s, normalizePath(strvalue))
 }
 
 func (s stringSet) has(strvalue string) bool {
-	_, ok := s[strvalue]
+	_, ok := s[normalizePath(strvalue)]
 	return ok
 }
 
+// MarshalJSON writes the set as a sorted array, so it reads sensibly in the structured log
+func (s stringSet) MarshalJSON() ([]byte, error) {
+	values := make([]string, 0, len(s))
+	for strvalue := range s {
+		values = append(values, strvalue)
+	}
+	sort.Strings(values)
+	return json.Marshal(values)
+}
+
+// hasPrefix reports whether any entry starts with <prefix>, ignoring case unless the depot is case-sensitive
+func (s stringSet) hasPrefix(prefix string) bool {
+	for strvalue := range s {
+		if strings.HasPrefix(strvalue, prefix) || (!AppConfig.CaseSensitiveDepot && strings.HasPrefix(strings.ToLower(strvalue), strings.ToLower(prefix))) {
+			return true
+		}
+	}
+	return false
+}
+
 // ----------------------------------------------------------------------------------------------------------
 // p4 operations by context
 //
@@ -82,8 +212,22 @@ var opsAdd = stringSet{
 var opsDel = stringSet{
 	"move/delete": {},
 	"delete":      {},
-	"purge":       {},
-	"archive":     {},
+}
+
+// purge and archive take a file's content out of storage, but its name stays in the depot - there's nothing for a
+// twin left behind to be orphaned from, so these are noted rather than checked like a delete
+var opsSpecialDelete = stringSet{
+	"purge":   {},
+	"archive": {},
+}
+var opsEdit = stringSet{
+	"edit": {},
+}
+
+// known, but not checked; listed so strict_mode can tell them apart from an operation p4unity has never heard of
+var opsUnchecked = stringSet{
+	"branch":    {},
+	"integrate": {},
 }
 var opsExists = stringSet{
 	"edit":     {},
@@ -102,6 +246,32 @@ var reFileRecordUnpack = regexp.MustCompile(`(?m)([^#]+)#(\d+) ([\w\/]+)$`)
 // extract just the "headAction <operation>" state line from a fstat call
 var reFindHeadActionOp = regexp.MustCompile(`(?m)headAction\s+([\w\/]+)`)
 
+// extract the "depotFile <path>" line that opens each record of a fstat call
+var reFindDepotFile = regexp.MustCompile(`(?m)depotFile\s+(.+)$`)
+
+// the "fileSize <bytes>" line from a fstat -Ol call
+var reFindFileSize = regexp.MustCompile(`(?m)fileSize\s+(\d+)`)
+
+// the "guid: <32 hex chars>" line every unity .meta file carries
+var reMetaGUID = regexp.MustCompile(`(?m)^guid:\s+([0-9a-f]{32})\s*$`)
+
+// pick out the interesting lines from 'p4 info', eg. "Server version: P4D/NTX64/2020.1/1966006 (2020/05/07)"
+var reP4InfoField = regexp.MustCompile(`(?m)^(?:info\d*:\s*)?(Server version|Case Handling|Unicode mode):\s*(.+?)\s*$`)
+
+// structured log keys for each of the reP4InfoField lines
+var p4InfoLogKeys = map[string]string{
+	"Server version": "server-version",
+	"Case Handling":  "case-handling",
+	"Unicode mode":   "unicode-mode",
+}
+
+// the first line of a describe, eg. "Change 9148 by harry_denholm@harry_pc on 2020/01/01 11:11:11 *pending*"
+// snapped into the changelist number, user, client and timestamp
+var reChangeHeader = regexp.MustCompile(`^Change\s+(\d+)\s+by\s+([^@\s]+)@(\S+)(?:\s+on\s+(\S+(?:\s+\d+:\d+:\d+)?))?`)
+
+// p4 failures that are worth trying again, as the server may just be busy
+var reTransientP4Failure = regexp.MustCompile(`(?i)connection refused|timed out`)
+
 // <file> - no file(s) at that changelist number. <- files exist, but not at given CL
 // <file> - no such file(s).                      <- files not known to P4 at all
 var reNoFilesMatch = regexp.MustCompile(`no\s+(?:such)?\s?file\(s\)`)
@@ -111,13 +281,34 @@ var reNoFilesMatch = regexp.MustCompile(`no\s+(?:such)?\s?file\(s\)`)
 // (with the prefix removed)
 //
 func filterStringsByType(s []string, p4type string) []string {
-	result := make([]string, 0, len(s))
+	indexed := filterStringsByTypeIndexed(s, p4type)
+	result := make([]string, 0, len(indexed))
+	for _, line := range indexed {
+		result = append(result, line.Value)
+	}
+	return result
+}
+
+// splitP4Lines breaks p4 output into lines; a p4d on windows ends them with \r\n, one on linux with just \n
+func splitP4Lines(out []byte) []string {
+	return strings.Split(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n")
+}
+
+// indexedLine is a filtered line along with where it was found in the original output
+type indexedLine struct {
+	Index int
+	Value string
+}
+
+// as filterStringsByType, but keeping each line's index within <s>, so it can be pointed at later
+func filterStringsByTypeIndexed(s []string, p4type string) []indexedLine {
+	result := make([]indexedLine, 0, len(s))
 	cutTypeLen := len(p4type)
-	for _, str := range s {
+	for index, str := range s {
 		if strings.HasPrefix(str, p4type) {
 			str = strings.TrimSpace(str[cutTypeLen:])
 			if str != "" {
-				result = append(result, str)
+				result = append(result, indexedLine{Index: index, Value: str})
 			}
 		}
 	}
@@ -125,97 +316,1132 @@ func filterStringsByType(s []string, p4type string) []string {
 }
 
 // ----------------------------------------------------------------------------------------------------------
+// the global flag that picks p4's output format for describe and fstat; see AppConfig.UseZtagOutput
+//
+func p4OutputFlag() string {
+	if AppConfig.UseZtagOutput {
+		return "-ztag"
+	}
+	return "-s"
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// unpack the output of a p4 command run with -ztag into one map per record; each field arrives as a line like
+// "... headAction edit", and records are separated by blank lines. a description can run over several lines (and
+// contain blank ones), so anything without the "... " prefix is taken as more of a preceding desc field
+//
+func parseZtagOutput(out []byte) []map[string]string {
+
+	records := make([]map[string]string, 0)
+	var record map[string]string
+	lastKey := ""
+
+	lines := splitP4Lines(out)
+	for _, line := range lines {
+
+		if !strings.HasPrefix(line, "... ") {
+			if lastKey == "desc" {
+				record[lastKey] += "\n" + line
+			} else if strings.TrimSpace(line) == "" {
+				record = nil
+			}
+			continue
+		}
+
+		if record == nil {
+			record = make(map[string]string)
+			records = append(records, record)
+		}
+
+		field := strings.SplitN(strings.TrimPrefix(line, "... "), " ", 2)
+		lastKey = field[0]
+		if len(field) == 2 {
+			record[lastKey] = field[1]
+		} else {
+			record[lastKey] = ""
+		}
+	}
+
+	for _, record := range records {
+		if desc, ok := record["desc"]; ok {
+			record["desc"] = strings.TrimRight(desc, "\n")
+		}
+	}
+	return records
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// rebuild a describe record (from -G or -ztag, which share field names) in the shape 'p4 -s describe' gives, so
+// the rest of app() needn't care which format was asked for; see the example in app(). the description only ever
+// lands on text: lines, so nobody can fake a file record by writing "info1:" in it
+//
+func describeLinesFromRecord(record map[string]string) []string {
+
+	header := fmt.Sprintf("text: Change %s by %s@%s", record["change"], record["user"], record["client"])
+	if epoch, err := strconv.ParseInt(record["time"], 10, 64); err == nil {
+		header += " on " + time.Unix(epoch, 0).Format("2006/01/02 15:04:05")
+	}
+	if record["status"] == "pending" {
+		header += " *pending*"
+	}
+
+	lines := []string{header, "text: "}
+	for _, descLine := range strings.Split(record["desc"], "\n") {
+		lines = append(lines, "text: \t"+descLine)
+	}
+	lines = append(lines, "text: ", "text: Affected files ...", "text: ")
+
+	for i := 0; ; i++ {
+		depotFile, ok := record[fmt.Sprintf("depotFile%d", i)]
+		if !ok {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("info1: %s#%s %s", depotFile, record[fmt.Sprintf("rev%d", i)], record[fmt.Sprintf("action%d", i)]))
+	}
+	return lines
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// time-rotating bypass codes; base64(HMAC-SHA256(secret, start of window as unix seconds)) for the current window
+// and the one before it, so a code generated just before the window rolls over still works for a while
+//
+func bypassHMACCodes(secret string, window time.Duration, now time.Time) []string {
+
+	windowSeconds := int64(window / time.Second)
+	if windowSeconds <= 0 {
+		return nil
+	}
+
+	windowStart := now.Unix() / windowSeconds * windowSeconds
+	codes := make([]string, 0, 2)
+	for _, start := range []int64{windowStart, windowStart - windowSeconds} {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(strconv.FormatInt(start, 10)))
+		codes = append(codes, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	}
+	return codes
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// pick the description out of the text lines of a describe; everything between the header and the file list,
+// cut short at <maxLines> (if above zero) so a long description can't flood the rejection
 //
-func fileExistsInDepot(depotPath string) (bool, error) {
+func changeDescription(p4text []string, maxLines int) []string {
+
+	description := make([]string, 0)
+	for _, line := range p4text[1:] {
+		if line == "Affected files ..." {
+			break
+		}
+		if maxLines > 0 && len(description) == maxLines {
+			description = append(description, "...")
+			break
+		}
+		description = append(description, line)
+	}
+	return description
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// check if a depot directory starts with <prefix>; if the prefix contains glob characters (* or ?) it is matched
+// against the same number of leading path segments instead, so "//Depot/*/Assets/" still acts like a prefix.
+// path.Match rather than filepath.Match, as depot paths always use forward slashes whatever the server OS
+//
+func pathMatchesPrefix(depotDirectory string, prefix string) bool {
+
+	if !strings.ContainsAny(prefix, "*?") {
+		return directoryHasPrefix(depotDirectory, prefix)
+	}
+
+	prefixSegments := strings.Count(prefix, "/")
+	directorySegments := strings.SplitAfter(depotDirectory, "/")
+	if len(directorySegments) < prefixSegments {
+		return false
+	}
 
-	cmd := exec.Command(
-		"p4",
-		"-p", AppConfig.PerforceServer,
+	leadingDirectory := strings.Join(directorySegments[:prefixSegments], "")
+	if !strings.HasSuffix(prefix, "/") && len(directorySegments) > prefixSegments {
+		// prefix ends part-way into a segment, eg. "//Depot/Proj*"; include that segment (sans slash) too
+		leadingDirectory += strings.TrimSuffix(directorySegments[prefixSegments], "/")
+	}
+
+	matched, err := path.Match(prefix, leadingDirectory)
+	if err != nil {
+		zLog.Warn("Whitelist", zap.String("bad-pattern", prefix), zap.Error(err))
+		return false
+	}
+	return matched
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// TriggerContext is who submitted the changelist being validated, from where and when
+//
+type TriggerContext struct {
+	Changelist int
+	User       string
+	Client     string
+	Timestamp  string
+}
+
+// parseChangeHeader unpacks the first text line of a describe; returns false if it isn't in the expected format
+func parseChangeHeader(header string) (TriggerContext, bool) {
+
+	matches := reChangeHeader.FindStringSubmatch(header)
+	if len(matches) == 0 {
+		return TriggerContext{}, false
+	}
+
+	changelist, _ := strconv.Atoi(matches[1])
+	return TriggerContext{
+		Changelist: changelist,
+		User:       matches[2],
+		Client:     matches[3],
+		Timestamp:  matches[4],
+	}, true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// does this asset need a .meta alongside it? everything does, unless asset_extensions_requiring_meta narrows
+// that down to a list of extensions, or asset_extensions_never_requiring_meta rules some out; the first list
+// wins if both are set. extensions are compared ignoring case
+//
+func assetRequiresMeta(depotPath string) bool {
+	assetExtension := filepath.Ext(depotPath)
+	if len(AppConfig.AssetExtensionRequiresMeta) > 0 {
+		for _, requiredExtension := range AppConfig.AssetExtensionRequiresMeta {
+			if strings.EqualFold(assetExtension, requiredExtension) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, excludedExtension := range AppConfig.AssetExtensionNeverRequiresMeta {
+		if strings.EqualFold(assetExtension, excludedExtension) {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// return the path of the other half of an asset/.meta pair; for a .meta that appears to belong to a directory
+// (no extension left once .meta is removed) there is no depot twin to find, so an empty string is returned
+//
+func metaTwinPath(depotPath string) string {
+	if filepath.Ext(depotPath) != ".meta" {
+		return depotPath + ".meta"
+	}
+	withoutMeta := depotPath[0 : len(depotPath)-len(".meta")]
+	if len(strings.TrimSpace(filepath.Ext(withoutMeta))) == 0 {
+		return ""
+	}
+	return withoutMeta
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// build a p4 command with the server connection and credentials from the config, followed by <args>
+//
+func p4Command(ctx context.Context, args ...string) *exec.Cmd {
+
+	connection := []string{
+		"-p", AppConfig.P4Port(),
 		"-u", AppConfig.PerforceUser,
-		"-P", AppConfig.PerforcePass,
-		"-s",
-		"fstat",
-		depotPath,
-	)
-	fstatOut, err := cmd.CombinedOutput()
+	}
+
+	// unicode-mode servers reject anything that doesn't name a charset
+	if AppConfig.PerforceCharset != "" {
+		connection = append([]string{"-C", AppConfig.PerforceCharset}, connection...)
+	}
+
+	// a tickets file takes precedence over the password; p4 picks the ticket up from P4TICKETS
+	if AppConfig.PerforceTicketFile == "" {
+		connection = append(connection, "-P", perforcePassword())
+	}
+
+	// anything else p4 needs is passed through the environment, on top of what we inherited; the trigger's
+	// environment is often sparse, so ssl trust can't be assumed to be configured
+	var p4Env []string
+	if AppConfig.PerforceTicketFile != "" {
+		p4Env = append(p4Env, "P4TICKETS="+AppConfig.PerforceTicketFile)
+	}
+	if AppConfig.PerforceTrustFile != "" {
+		p4Env = append(p4Env, "P4TRUST="+AppConfig.PerforceTrustFile)
+	}
+	if AppConfig.PerforceSSL && AppConfig.PerforceSSLDir != "" {
+		p4Env = append(p4Env, "P4SSLDIR="+AppConfig.PerforceSSLDir)
+	}
+
+	cmd := exec.CommandContext(ctx, "p4", append(connection, args...)...)
+	if len(p4Env) > 0 {
+		cmd.Env = append(os.Environ(), p4Env...)
+	}
+	return cmd
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// run a p4 command using the retry settings from the config
+//
+func runP4(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	return runP4WithRetry(ctx, cmd, AppConfig.ConnectionRetryCount, time.Duration(AppConfig.ConnectionRetryDelayMs)*time.Millisecond)
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// the password (or ticket) to pass as -P; a password file is re-read on every call, rather than cached, so
+// rotated credentials are picked up without touching the config
+//
+func perforcePassword() string {
+
+	if AppConfig.PerforcePassFile == "" {
+		return AppConfig.PerforcePass
+	}
+
+	passBytes, err := ioutil.ReadFile(AppConfig.PerforcePassFile)
+	if err != nil {
+		zLog.Warn("Credentials", zap.String("file", AppConfig.PerforcePassFile), zap.Error(err))
+		return ""
+	}
+	return strings.TrimSpace(string(passBytes))
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// run a p4 command, returning the combined output; busy servers occasionally drop connections, so failures that
+// look network-related are retried up to <retries> times, sleeping delay * 2^attempt in between. anything else
+// fails straight away, as does running out of time on <ctx>
+//
+func runP4WithRetry(ctx context.Context, cmd *exec.Cmd, retries int, delay time.Duration) ([]byte, error) {
+
+	for attempt := 0; ; attempt++ {
+
+		output, err := cmd.CombinedOutput()
+		if err == nil || attempt >= retries || ctx.Err() != nil || !reTransientP4Failure.Match(output) {
+			return output, err
+		}
+
+		backoff := delay * time.Duration(1<<uint(attempt))
+		zLog.Warn("p4-retry",
+			zap.Strings("args", cmd.Args),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.String("output", string(output)),
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return output, err
+		}
+
+		// the server has been flaky, so don't trust anything it told us earlier
+		depotResultCache.invalidate()
+
+		// an exec.Cmd can only be run once, so build a fresh copy for the next go
+		retryCmd := exec.CommandContext(ctx, cmd.Path, cmd.Args[1:]...)
+		retryCmd.Env = cmd.Env
+		retryCmd.Dir = cmd.Dir
+		cmd = retryCmd
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// ValidationResultCache remembers the answers to depot existence checks for the lifetime of the process, so the
+// same path is never fstat'd twice in one run; safe to use from the fstat workers
+//
+type ValidationResultCache struct {
+	lock   sync.Mutex
+	exists map[string]bool
+}
+
+func validationCacheKey(depotPath string, atChangelist int) string {
+	return fmt.Sprintf("%s@%d", depotPath, atChangelist)
+}
+
+func (c *ValidationResultCache) get(depotPath string, atChangelist int) (bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	exists, ok := c.exists[validationCacheKey(depotPath, atChangelist)]
+	return exists, ok
+}
+
+func (c *ValidationResultCache) set(depotPath string, atChangelist int, exists bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.exists == nil {
+		c.exists = make(map[string]bool)
+	}
+	c.exists[validationCacheKey(depotPath, atChangelist)] = exists
+}
+
+func (c *ValidationResultCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.exists = nil
+}
+
+var depotResultCache ValidationResultCache
+
+// ----------------------------------------------------------------------------------------------------------
+// p4 has practical limits on how long an argument list can get, so batched fstat calls are split into chunks
+//
+const fstatBatchSize = 200
+
+// ----------------------------------------------------------------------------------------------------------
+//
+func fileExistsInDepot(ctx context.Context, runner P4Runner, depotPath string, atChangelist int) (bool, error) {
+
+	existsInDepot, err := fileExistsInDepotBatch(ctx, runner, []string{depotPath}, atChangelist)
+	if err != nil {
+		return false, err
+	}
+	return existsInDepot[depotPath], nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// does this output, from a failed fstat, only complain about files that aren't in the depot? any other error
+// (connection, permissions ..) alongside means the failure was real
+//
+func fstatFailedOnlyOnMissingFiles(fstatOut []byte) bool {
+
+	missingFiles := false
+	for _, line := range splitP4Lines(fstatOut) {
+		line = strings.TrimSpace(line)
+		switch {
+		case reNoFilesMatch.MatchString(line):
+			missingFiles = true
+		case line == "", strings.HasPrefix(line, "info"), strings.HasPrefix(line, "..."), strings.HasPrefix(line, "exit:"):
+			// records for the files that do exist, and -s's closing exit code
+		default:
+			return false
+		}
+	}
+	return missingFiles
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// the fields fstat is asked to return with -T, from fstat_fields; depotFile is always among them, as every
+// record is matched back to its path by it. empty means fstat returns everything
+//
+func fstatFieldList() string {
+
+	if strings.TrimSpace(AppConfig.FstatFields) == "" {
+		return ""
+	}
+	fields := []string{"depotFile"}
+	for _, field := range strings.FieldsFunc(AppConfig.FstatFields, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if field != "depotFile" {
+			fields = append(fields, field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// fstat a list of depot paths in as few p4 invocations as possible; returns a map of path -> exists, where
+// 'exists' means the head action infers the file is in the depot at this time (see opsExists)
+//
+// with a non-zero <atChangelist> the query is pinned to the depot as of that changelist, so files submitted
+// by someone else while we're working don't muddy the answer
+//
+func fileExistsInDepotBatch(ctx context.Context, runner P4Runner, depotPaths []string, atChangelist int) (map[string]bool, error) {
+
+	result := make(map[string]bool, len(depotPaths))
+
+	// anything we've already asked about during this run can be answered straight away
+	uncachedPaths := make([]string, 0, len(depotPaths))
+	for _, depotPath := range depotPaths {
+		if exists, ok := depotResultCache.get(depotPath, atChangelist); ok {
+			result[depotPath] = exists
+		} else {
+			uncachedPaths = append(uncachedPaths, depotPath)
+		}
+	}
+	depotPaths = uncachedPaths
+
+	for chunkStart := 0; chunkStart < len(depotPaths); chunkStart += fstatBatchSize {
+
+		chunkEnd := chunkStart + fstatBatchSize
+		if chunkEnd > len(depotPaths) {
+			chunkEnd = len(depotPaths)
+		}
+		chunk := depotPaths[chunkStart:chunkEnd]
+
+		fileSpecs := make([]string, 0, len(chunk))
+		for _, depotPath := range chunk {
+			if atChangelist > 0 {
+				depotPath = fmt.Sprintf("%s@%d", depotPath, atChangelist)
+			}
+			fileSpecs = append(fileSpecs, depotPath)
+		}
+
+		// each call gets its own deadline, so one slow fstat can't eat the whole of the overall timeout
+		fstatCtx, cancel := ctx, context.CancelFunc(func() {})
+		if AppConfig.FstatTimeoutSeconds > 0 {
+			fstatCtx, cancel = context.WithTimeout(ctx, time.Duration(AppConfig.FstatTimeoutSeconds)*time.Second)
+		}
+		fstatOut, err := runner.Fstat(fstatCtx, fileSpecs, fstatFieldList())
+		timedOut := fstatCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		// a timed-out chunk gets no answer at all, rather than a guess either way; its paths are left out of the
+		// result, and app() skips the checks that depend on them - a problem could slip through, but a slow server
+		// won't reject a changelist that's fine
+		if timedOut {
+			zLog.Warn("fstat-timeout", zap.Strings("paths", chunk), zap.Int("seconds", AppConfig.FstatTimeoutSeconds))
+			continue
+		}
+		// p4 exits non-zero when some of the files were never submitted, just as it does for a real failure; the
+		// former is a perfectly good answer (not in the depot) for a brand new asset, so only the latter is an error
+		if err != nil {
+			if !fstatFailedOnlyOnMissingFiles(fstatOut) {
+				errMsg("failed to launch P4; %s\n%s\n\n", err, fstatOut)
+				return nil, err
+			}
+			zLog.Info("fstat", zap.String("ignored", err.Error()))
+		}
+
+		fstatOutString := string(fstatOut)
+		zLog.Info("fstat", zap.Int("paths", len(chunk)), zap.String("out", fstatOutString))
+
+		// each file comes back as a block of fields, separated by blank lines; the block opens with the depotFile
+		// so we track that and attribute the block's headAction to it
+		headActions := make(map[string]string, len(chunk))
+		headActionsIgnoringCase := make(map[string]string, len(chunk))
+
+		if AppConfig.UseZtagOutput {
+			// -ztag hands back one record per file, so there's nothing to track between lines
+			for _, record := range parseZtagOutput(fstatOut) {
+				if record["depotFile"] != "" && record["headAction"] != "" {
+					headActions[record["depotFile"]] = record["headAction"]
+					headActionsIgnoringCase[strings.ToLower(record["depotFile"])] = record["headAction"]
+				}
+			}
+		} else {
+			currentDepotFile := ""
+			for _, line := range splitP4Lines(fstatOut) {
+
+				if depotFile := reFindDepotFile.FindStringSubmatch(line); len(depotFile) != 0 {
+					currentDepotFile = strings.TrimSpace(depotFile[1])
+					continue
+				}
+				if headAction := reFindHeadActionOp.FindStringSubmatch(line); len(headAction) != 0 && currentDepotFile != "" {
+					headActions[currentDepotFile] = headAction[1]
+					headActionsIgnoringCase[strings.ToLower(currentDepotFile)] = headAction[1]
+					continue
+				}
+				// a blank record closes the current block
+				if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "info:")) == "" {
+					currentDepotFile = ""
+				}
+			}
+		}
+
+		for _, depotPath := range chunk {
+
+			headAction, ok := headActions[depotPath]
+			if !ok && !AppConfig.CaseSensitiveDepot {
+				headAction, ok = headActionsIgnoringCase[strings.ToLower(depotPath)]
+			}
+			if !ok {
+				zLog.Info("fstat", zap.String("path", depotPath), zap.String("failed", "no headAction"))
+				result[depotPath] = false
+				depotResultCache.set(depotPath, atChangelist, false)
+				continue
+			}
+
+			// check if the head action is appropriate; eg. add, edit - something that infers this file in the depot at this time
+			if !opsExists.has(headAction) {
+				zLog.Info("fstat", zap.String("path", depotPath), zap.String("ignored_action", headAction))
+				result[depotPath] = false
+				depotResultCache.set(depotPath, atChangelist, false)
+				continue
+			}
+
+			result[depotPath] = true
+			depotResultCache.set(depotPath, atChangelist, true)
+		}
+	}
+
+	return result, nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// p4 has no entries for directories themselves, but 'p4 dirs' will list one that has files in it; as with fstat,
+// a non-zero <atChangelist> asks about the depot as of that changelist
+//
+func directoryExistsInDepot(ctx context.Context, runner P4Runner, depotDirectory string, atChangelist int) (bool, error) {
+
+	dirsArg := depotDirectory
+	if atChangelist > 0 {
+		dirsArg = fmt.Sprintf("%s@%d", depotDirectory, atChangelist)
+	}
+
+	dirsOut, err := runner.Dirs(ctx, dirsArg)
 	if err != nil {
-		fmt.Printf("[p4unity] failed to launch P4; %s\n%s\n\n", err, fstatOut)
+		errMsg("failed to launch P4; %s\n%s\n\n", err, dirsOut)
 		return false, err
 	}
+	zLog.Info("dirs", zap.String("path", depotDirectory), zap.String("out", string(dirsOut)))
 
-	fstatOutString := string(fstatOut)
-	zLog.Info("fstat", zap.String("out", fstatOutString))
+	for _, foundDirectory := range filterStringsByType(splitP4Lines(dirsOut), "info:") {
+		if foundDirectory == depotDirectory || (!AppConfig.CaseSensitiveDepot && strings.EqualFold(foundDirectory, depotDirectory)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	fstatHeadAction := reFindHeadActionOp.FindStringSubmatch(fstatOutString)
+// ----------------------------------------------------------------------------------------------------------
+// fetch the content of a .meta file as submitted in the given changelist and pull out the GUID unity assigned it;
+// returns an empty string if there is no well-formed guid line
+//
+func metaGUIDInChangelist(ctx context.Context, runner P4Runner, depotPath string, changelist int) (string, error) {
+	return metaGUIDAt(ctx, runner, fmt.Sprintf("%s@=%d", depotPath, changelist))
+}
+
+// metaGUIDAt is metaGUIDInChangelist for any file spec, eg. "//Depot/Thing.meta#head"
+func metaGUIDAt(ctx context.Context, runner P4Runner, fileSpec string) (string, error) {
+
+	printOut, err := runner.Print(ctx, fileSpec)
+	if err != nil {
+		errMsg("failed to launch P4; %s\n%s\n\n", err, printOut)
+		return "", err
+	}
 
-	if len(fstatHeadAction) == 0 {
-		zLog.Info("fstat", zap.String("failed", "regex fail"))
-		return false, nil
+	guid := reMetaGUID.FindStringSubmatch(string(printOut))
+	if len(guid) == 0 {
+		zLog.Info("print", zap.String("path", fileSpec), zap.String("failed", "no guid"), zap.Int("bytes", len(printOut)))
+		return "", nil
 	}
+	return guid[1], nil
+}
 
-	// check if the head action is appropriate; eg. add, edit - something that infers this file in the depot at this time
-	fstatHeadActionOp := fstatHeadAction[1]
+// ----------------------------------------------------------------------------------------------------------
+// ask the server how big a file is as submitted in the given changelist; returns -1 if fstat didn't report a size
+//
+func fileSizeInChangelist(ctx context.Context, runner P4Runner, depotPath string, changelist int) (int64, error) {
 
-	if !opsExists.has(fstatHeadActionOp) {
-		zLog.Info("fstat", zap.String("ignored_action", fstatHeadActionOp))
-		return false, nil
+	fstatOut, err := runner.FileSize(ctx, fmt.Sprintf("%s@=%d", depotPath, changelist))
+	if err != nil {
+		errMsg("failed to launch P4; %s\n%s\n\n", err, fstatOut)
+		return -1, err
 	}
 
-	return true, nil
+	fileSize := reFindFileSize.FindSubmatch(fstatOut)
+	if len(fileSize) == 0 {
+		zLog.Info("fstat", zap.String("path", depotPath), zap.String("failed", "no fileSize"), zap.String("out", string(fstatOut)))
+		return -1, nil
+	}
+	return strconv.ParseInt(string(fileSize[1]), 10, 64)
 }
 
 // ----------------------------------------------------------------------------------------------------------
-func app() int {
+// make sure the p4 server can be reached at all, with a short timeout of its own; the output of 'p4 info' is
+// logged so the verbose log shows exactly which server (and what kind of server) was contacted
+//
+const p4ConnectivityTimeout = 3 * time.Second
+
+func checkP4Connectivity(ctx context.Context, runner P4Runner) bool {
 
-	argsWithoutProg := os.Args[1:]
-	fmt.Print("\n\n")
-	zLog.Info("Boot", zap.Strings("args", argsWithoutProg))
+	infoCtx, cancel := context.WithTimeout(ctx, p4ConnectivityTimeout)
+	defer cancel()
 
-	if len(argsWithoutProg) < 1 {
-		fmt.Printf("usage: p4unity <changelist>\n\n")
-		return p4ExitErrorUsage
+	infoOut, err := runner.Info(infoCtx)
+	infoOutString := string(infoOut)
+	if err != nil || !strings.HasPrefix(infoOutString, "info:") {
+		zLog.Warn("p4-info", zap.String("port", AppConfig.P4Port()), zap.Error(err), zap.String("output", infoOutString))
+		return false
 	}
 
-	// check we got a changelist number on the command line
-	changelist, err := strconv.Atoi(argsWithoutProg[0])
+	infoFields := []zap.Field{
+		zap.String("port", AppConfig.P4Port()),
+		zap.String("output", infoOutString),
+	}
+	for _, field := range reP4InfoField.FindAllStringSubmatch(infoOutString, -1) {
+		infoFields = append(infoFields, zap.String(p4InfoLogKeys[field[1]], field[2]))
+	}
+	zLog.Info("p4-info", infoFields...)
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// add <delta> to a p4 counter; p4 has no 'add n' so the value is read, bumped and written back, which can lose a
+// count if two triggers race - close enough for statistics
+//
+func incrementP4Counter(ctx context.Context, runner P4Runner, counter string, delta int) error {
+
+	counterOut, err := runner.Counter(ctx, counter)
 	if err != nil {
-		fmt.Printf("[p4unity] changelist %s not a number (%s)\n\n", argsWithoutProg[0], err)
-		return p4ExitErrorUsage
+		return fmt.Errorf("%s; %s", err, strings.TrimSpace(string(counterOut)))
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(counterOut)))
+	if err != nil {
+		return err
 	}
 
-	// talk to p4, get the description of the given changelist
-	cmd := exec.Command(
-		"p4",
-		"-p", AppConfig.PerforceServer,
-		"-u", AppConfig.PerforceUser,
-		"-P", AppConfig.PerforcePass,
-		"-s",
-		"describe",
-		"-s",
-		strconv.FormatInt(int64(changelist), 10),
-	)
-	p4out, err := cmd.CombinedOutput()
+	counterOut, err = runner.SetCounter(ctx, counter, value+delta)
 	if err != nil {
-		fmt.Printf("[p4unity] failed to launch P4; %s\n%s\n\n", err, p4out)
-		return p4ExitErrorUsage
+		return fmt.Errorf("%s; %s", err, strings.TrimSpace(string(counterOut)))
 	}
+	return nil
+}
 
-	// log out the result for tracing
-	p4outString := string(p4out)
-	zLog.Info("p4-describe", zap.String("output", p4outString))
+// record this run in the <prefix>.* counters on the server; a built-in (if basic) metrics store. failures are only
+// logged, statistics must never get in the way of the trigger
+func recordStats(ctx context.Context, runner P4Runner, prefix string, filesChecked int, problemsFound int) {
+
+	counters := []struct {
+		name  string
+		delta int
+	}{
+		{"total_runs", 1},
+		{"files_checked", filesChecked},
+		{"problems_found", problemsFound},
+	}
+	for _, counter := range counters {
+		counterName := prefix + "." + counter.name
+		if err := incrementP4Counter(ctx, runner, counterName, counter.delta); err != nil {
+			zLog.Warn("Stats", zap.String("counter", counterName), zap.Error(err))
+		}
+	}
+}
 
-	// turn the result into individual lines we can step through
-	p4lines := strings.Split(p4outString, "\r\n")
-	zLog.Info("p4-describe", zap.Int("split-lines", len(p4lines)))
+// ----------------------------------------------------------------------------------------------------------
+// list the depot paths still open in <changelist>, from 'p4 opened -c'
+//
+func openedFilesInChangelist(ctx context.Context, runner P4Runner, changelist int) ([]string, error) {
+
+	openedOut, err := runner.Opened(ctx, changelist)
+	if err != nil {
+		return nil, fmt.Errorf("%s; %s", err, strings.TrimSpace(string(openedOut)))
+	}
+
+	openedFiles := make([]string, 0)
+	for _, record := range filterStringsByType(splitP4Lines(openedOut), "info:") {
+		matches := reFilesRecordUnpack.FindStringSubmatch(record)
+		if len(matches) != 2 {
+			zLog.Warn("Opened", zap.String("unparsed", record))
+			continue
+		}
+		openedFiles = append(openedFiles, matches[1])
+	}
+	return openedFiles, nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// list the p4 groups <user> belongs to, one per info line from 'p4 groups -u'
+//
+func userGroups(ctx context.Context, runner P4Runner, user string) ([]string, error) {
+
+	groupsOut, err := runner.Groups(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("%s; %s", err, strings.TrimSpace(string(groupsOut)))
+	}
+	return filterStringsByType(splitP4Lines(groupsOut), "info:"), nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// labelledDirectories holds the directory of every file on a label_whitelist label, lowered unless the depot is
+// case-sensitive; filled by loadLabelWhitelist, before any validation starts
+var labelledDirectories = make(stringSet)
+
+// loadLabelWhitelist runs 'p4 files @<label>' for each of label_whitelist, for depots where the unity projects
+// are marked by label rather than sitting under a common root that path_whitelist could name
+func loadLabelWhitelist(ctx context.Context, runner P4Runner) error {
+
+	for _, label := range AppConfig.LabelWhitelist {
+
+		filesOut, err := runner.Files(ctx, "@"+label, false)
+		if err != nil {
+			return fmt.Errorf("label '%s'; %s; %s", label, err, strings.TrimSpace(string(filesOut)))
+		}
+
+		labelFiles := 0
+		for _, record := range filterStringsByType(splitP4Lines(filesOut), "info:") {
+			matches := reFilesRecordUnpack.FindStringSubmatch(record)
+			if len(matches) != 2 {
+				zLog.Warn("Labels", zap.String("unparsed", record))
+				continue
+			}
+			labelDirectory, _ := filepath.Split(matches[1])
+			if !AppConfig.CaseSensitiveDepot {
+				labelDirectory = strings.ToLower(labelDirectory)
+			}
+			labelledDirectories.add(labelDirectory)
+			labelFiles++
+		}
+		zLog.Info("Labels", zap.String("label", label), zap.Int("files", labelFiles))
+	}
+	return nil
+}
+
+// directoryIsLabelled reports whether <itemDirectory>, or any directory above it, holds a file on one of the labels
+func directoryIsLabelled(itemDirectory string) bool {
+
+	directory := normalizePath(itemDirectory)
+	if !AppConfig.CaseSensitiveDepot {
+		directory = strings.ToLower(directory)
+	}
+	for strings.LastIndex(directory, "/") > 1 {
+		if labelledDirectories.has(directory) {
+			return true
+		}
+		directory = directory[:strings.LastIndex(directory, "/")]
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// ask the server whether our credentials are good; 'login -s' only reports on the current ticket or password, it
+// never prompts. returns p4's response, for the log or the user
+//
+func checkP4Login(ctx context.Context, runner P4Runner) (string, bool) {
+
+	loginOut, err := runner.Login(ctx)
+	loginOutString := strings.TrimSpace(string(loginOut))
+	return loginOutString, err == nil && !strings.Contains(loginOutString, "error:")
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// fan the depot paths out across a pool of workers, each running batched fstat calls; results are gathered
+// back into a single map once every worker has finished. the first error encountered is returned
+//
+func fileExistsInDepotParallel(ctx context.Context, runner P4Runner, depotPaths []string, atChangelist int, workerCount int) (map[string]bool, error) {
+
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	chunks := make(chan []string)
+
+	var resultLock sync.Mutex
+	result := make(map[string]bool, len(depotPaths))
+	var firstErr error
+
+	var workers sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for chunk := range chunks {
+				existsInDepot, err := fileExistsInDepotBatch(ctx, runner, chunk, atChangelist)
+
+				resultLock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					for depotPath, exists := range existsInDepot {
+						result[depotPath] = exists
+					}
+				}
+				resultLock.Unlock()
+			}
+		}()
+	}
+
+	for chunkStart := 0; chunkStart < len(depotPaths); chunkStart += fstatBatchSize {
+		chunkEnd := chunkStart + fstatBatchSize
+		if chunkEnd > len(depotPaths) {
+			chunkEnd = len(depotPaths)
+		}
+		chunks <- depotPaths[chunkStart:chunkEnd]
+	}
+	close(chunks)
+
+	workers.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// phaseTimings breaks down where the time goes in a run, to tell p4 latency apart from time spent in our own checks
+//
+type phaseTimings struct {
+	describe  time.Duration
+	fstat     time.Duration
+	addChecks time.Duration
+	delChecks time.Duration
+}
+
+func (t *phaseTimings) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddDuration("describe", t.describe)
+	enc.AddDuration("fstat", t.fstat)
+	enc.AddDuration("add-checks", t.addChecks)
+	enc.AddDuration("del-checks", t.delChecks)
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// when a p4 call fails, check if it's because we ran out of time overall; that gets reported (and exits) as such,
+// otherwise the given exit code is passed back
+//
+func p4FailureExit(ctx context.Context, exitCode int) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		errMsg("timed out after %ds\n\n", AppConfig.OverallTimeoutSeconds)
+		return p4ExitErrorException
+	}
+	return exitCode
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// check <filePath> against path_bypass_rules, for areas of the depot known to be in a bad state (legacy assets,
+// third-party imports ..) that shouldn't block a changelist; the longest matching prefix, and its reason, is logged
+//
+func pathIsBypassed(filePath string) bool {
+
+	matchedPrefix := ""
+	for prefix := range AppConfig.PathBypassRules {
+		if len(prefix) > len(matchedPrefix) && (strings.HasPrefix(filePath, prefix) || (!AppConfig.CaseSensitiveDepot && strings.HasPrefix(strings.ToLower(filePath), strings.ToLower(prefix)))) {
+			matchedPrefix = prefix
+		}
+	}
+	if matchedPrefix == "" {
+		return false
+	}
+	zLog.Warn("PathBypass", zap.String("file", filePath), zap.String("prefix", matchedPrefix), zap.String("reason", AppConfig.PathBypassRules[matchedPrefix]))
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// run a file from the depot through the configured filters - ignored directories, dotfiles and extensions, the
+// whitelist and blacklist, and the assets folder patterns - to see whether it should be validated at all; the
+// reason for skipping it is logged to <itemLog>
+//
+func shouldValidateFile(itemDirectory string, itemFilename string, itemLog *zap.Logger) bool {
+
+	// a directory that terminates with a ~ should be ignored; unity does not import anything within (eg. Documentation~/,
+	// Samples~/ in packages) so none of it will have .meta files. the default pattern of "~/" catches exactly that,
+	// but the config can add other conventions (eg. "_hidden/"), or disable this entirely with an empty list
+	pathIgnoredBy := ""
+	for _, ignoredPattern := range AppConfig.IgnoredDirectoryPatterns {
+		if strings.Contains(itemDirectory, ignoredPattern) {
+			pathIgnoredBy = ignoredPattern
+			break
+		}
+	}
+	if pathIgnoredBy != "" {
+		itemLog.Debug("TildeIgnored", zap.String("pattern", pathIgnoredBy))
+		return false
+	}
+
+	// ignore .p4ignore, .tests.json et al; entries are filenames or filename prefixes, so the default of "."
+	// skips every dotfile - an empty list means dotfiles get validated like anything else
+	fileIsIgnored := false
+	for _, dotExclusion := range AppConfig.DotFileExclusions {
+		if strings.HasPrefix(itemFilename, dotExclusion) {
+			fileIsIgnored = true
+			break
+		}
+	}
+	if fileIsIgnored {
+		itemLog.Debug("DotIgnored")
+		return false
+	}
+
+	// some file types never get a .meta from unity (Thumbs.db, .DS_Store ..) so leave them out of the checks
+	itemExtension := filepath.Ext(itemFilename)
+	for _, ignoredExtension := range AppConfig.IgnoredExtensions {
+		if strings.EqualFold(itemExtension, ignoredExtension) {
+			fileIsIgnored = true
+			break
+		}
+	}
+	if fileIsIgnored {
+		itemLog.Debug("ExtensionIgnored", zap.String("extension", itemExtension))
+		return false
+	}
+
+	// check the whitelist to see if we should be looking at this file at all
+	pathIsValidToCheck := false
+	// some p4 clients hand back paths in a different case to the one the whitelist was written in; with
+	// path_whitelist_case_sensitive off both sides are lowered, at the risk of matching more than intended
+	whitelistDirectory := itemDirectory
+	if !AppConfig.PathWhitelistCaseSensitive {
+		whitelistDirectory = strings.ToLower(itemDirectory)
+	}
+	for _, whitelist := range AppConfig.PathWhitelist {
+		whitelistPrefix := whitelist
+		if !AppConfig.PathWhitelistCaseSensitive {
+			whitelistPrefix = strings.ToLower(whitelist)
+		}
+		if pathMatchesPrefix(whitelistDirectory, whitelistPrefix) {
+			itemLog.Debug("Whitelist", zap.String("passed", whitelist))
+			pathIsValidToCheck = true
+			break
+		}
+	}
+	// .. failing that, any regular expressions, for layouts a prefix can't express
+	if !pathIsValidToCheck {
+		for _, whitelistRegex := range compiledWhitelistRegex {
+			if whitelistRegex.MatchString(itemDirectory) {
+				itemLog.Debug("Whitelist", zap.String("passed-regex", whitelistRegex.String()))
+				pathIsValidToCheck = true
+				break
+			}
+		}
+	}
+	// .. or sits alongside (or below) anything on one of the whitelisted labels
+	if !pathIsValidToCheck && len(labelledDirectories) > 0 && directoryIsLabelled(itemDirectory) {
+		itemLog.Debug("Whitelist", zap.String("passed-label", itemDirectory))
+		pathIsValidToCheck = true
+	}
+	// .. and then the blacklist, which takes precedence over anything the whitelist let through
+	if pathIsValidToCheck {
+		for _, blacklist := range AppConfig.PathBlacklist {
+			if directoryHasPrefix(itemDirectory, blacklist) {
+				itemLog.Debug("Blacklist", zap.String("excluded", blacklist))
+				pathIsValidToCheck = false
+				break
+			}
+		}
+	}
+	if !pathIsValidToCheck {
+		itemLog.Debug("Whitelist-Failed")
+		return false
+	}
+
+	// this is a shitty vague way of only apply rules to the inside of Unity assets folders; by default just "/Assets/",
+	// but the config can name others - or several, when moving between folder layouts
+	// TBD: something smarter, like fstat'ing a sibling path of "/Packages/" for example
+	pathIsInAssets := false
+	for _, assetsPattern := range AppConfig.AssetsFolderPatterns {
+		if strings.Contains(itemDirectory, assetsPattern) {
+			pathIsInAssets = true
+			break
+		}
+	}
+	// embedded packages hold real assets too, if the config names where they live
+	if !pathIsInAssets && pathIsInPackages(itemDirectory) {
+		itemLog.Debug("PackagesPath")
+		pathIsInAssets = true
+	}
+	if !pathIsInAssets {
+		itemLog.Debug("AssetsPath-Failed")
+		return false
+	}
+
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// is <depotPath> inside an embedded package folder, per packages_folder_patterns? matched like the assets folder
+// patterns, as a fragment anywhere in the path
+//
+func pathIsInPackages(depotPath string) bool {
+	for _, packagesPattern := range AppConfig.PackagesFolderPatterns {
+		if strings.Contains(depotPath, packagesPattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// app checks a single changelist, with <runner> answering every p4 query
+//
+func app(ctx context.Context, runner P4Runner) (int, AppReport) {
+
+	// what happened, for callers that want more than the exit code
+	var report AppReport
+
+	// the changelist fields get bolted onto zLog once the header is parsed, so helpers log them too; put the
+	// caller's logger back afterwards so one run's fields don't leak into the next
+	defer func(previous *zap.Logger) {
+		zLog = previous
+	}(zLog)
+
+	// how long each phase takes, logged on the way out whichever way that is
+	var timings phaseTimings
+	defer func() {
+		zLog.Info("Timings", zap.Object("phases", &timings))
+	}()
+
+	argsWithoutProg := flag.Args()
+	fmt.Fprint(output, "\n\n")
+	zLog.Info("Boot", zap.Strings("args", argsWithoutProg), zap.Bool("dry-run", dryRun), zap.Bool("simulate", AppConfig.Simulate))
+	if AppConfig.Simulate && !AppConfig.JSONOutput {
+		fmt.Fprintf(output, "%s[SIMULATE] This trigger is in simulation mode - no commits are being blocked\n\n", AppConfig.ErrorPrefix)
+	}
+	if AppConfig.VerboseLogs {
+		zLog.Info("Config", AppConfig.LogFields()...)
+	}
+
+	changelistArg := changelistArgument()
+	if changelistArg == "" {
+		fmt.Fprintf(output, "usage: p4unity [-config <path>] [-dry-run] <changelist>\n       (or set P4U_CHANGELIST)\n       p4unity [-config <path>] health\n       p4unity [-config <path>] check-config\n       p4unity [-config <path>] list-orphans <depot path>\n       p4unity init [-write]\n\n")
+		return p4ExitErrorUsage, report
+	}
+
+	// check we got a changelist number
+	changelist, err := strconv.Atoi(changelistArg)
+	if err != nil {
+		errMsg("changelist %s not a number (%s)\n\n", changelistArg, err)
+		return p4ExitErrorUsage, report
+	}
+	report.Changelist = changelist
+
+	// talk to p4, get the description of the given changelist; as marshal'd records (-G) unless ztag was asked for
+	describeStart := time.Now()
+	var p4out []byte
+	if describeFile != "" {
+		zLog.Info("p4-describe", zap.String("file", describeFile))
+		p4out, err = ioutil.ReadFile(describeFile)
+		if err != nil {
+			errMsg("could not read describe file '%s'; %s\n\n", describeFile, err)
+			return p4ExitErrorUsage, report
+		}
+	} else {
+		// a deadline of its own, tighter than the overall one; everything else hangs off this call
+		describeCtx, cancel := ctx, context.CancelFunc(func() {})
+		if AppConfig.DescribeTimeoutSeconds > 0 {
+			describeCtx, cancel = context.WithTimeout(ctx, time.Duration(AppConfig.DescribeTimeoutSeconds)*time.Second)
+		}
+		p4out, err = runner.Describe(describeCtx, changelist)
+		timedOut := describeCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		if timedOut {
+			errMsg("p4 describe timed out after %ds\n\n", AppConfig.DescribeTimeoutSeconds)
+			return p4ExitErrorException, report
+		}
+		if err != nil {
+			errMsg("failed to launch P4; %s\n%s\n\n", err, p4out)
+			return p4FailureExit(ctx, p4ExitErrorUsage), report
+		}
+	}
+	timings.describe = time.Since(describeStart)
+
+	// the changelist comes back as a single record of fields
+	var describeRecords []map[string]string
+	if AppConfig.UseZtagOutput {
+		describeRecords = parseZtagOutput(p4out)
+	} else {
+		describeRecords, err = parseMarshalOutput(p4out)
+		if err != nil {
+			errMsg("could not decode p4 describe [%d] output; %s\n\n", changelist, err)
+			return p4ExitErrorException, report
+		}
+	}
+
+	// log out the result for tracing
+	zLog.Info("p4-describe", zap.Any("records", describeRecords))
 
 	// early out if we asked for a missing CL; this would mean p4d screwed up somehow? how can we fire a trigger for a CL that doesn't exist...
-	if strings.Contains(p4lines[0], "no such changelist") {
-		fmt.Printf("[p4unity] cannot find changelist [%d]\n\n", changelist)
-		return p4ExitErrorUsage
+	if len(describeRecords) > 0 && describeRecords[0]["code"] == "error" {
+		errMsg("cannot find changelist [%d]\n( %s )\n\n", changelist, strings.TrimSpace(describeRecords[0]["data"]))
+		return p4ExitErrorUsage, report
 	}
 
-	// strip into the header text and info blocks; running the p4 '-s' global flag
-	// usefully separates the output; https://community.perforce.com/s/article/3505
+	// reshape the record into the lines that running with the p4 '-s' global flag would give, which usefully
+	// separates the header text and info blocks; https://community.perforce.com/s/article/3505
+	p4lines := []string{}
+	if len(describeRecords) > 0 {
+		p4lines = describeLinesFromRecord(describeRecords[0])
+	}
+	zLog.Info("p4-describe", zap.Int("split-lines", len(p4lines)))
+
 	//
 	// [text: Change 9148 by harry_denholm@harry_pc on 2020/01/01 11:11:11 *pending*]
 	// [text: ]
@@ -238,31 +1464,142 @@ func app() int {
 		zap.Int("p4fileCount", p4fileCount),
 	)
 
-	// no header, no idea
-	if p4headerLines == 0 {
-		fmt.Printf("[p4unity] p4 describe [%d] output is empty\n\n", changelist)
-		return p4ExitErrorEmpty
+	// no header, no idea
+	if p4headerLines == 0 {
+		errMsg("p4 describe [%d] output is empty\n\n", changelist)
+		return p4ExitErrorEmpty, report
+	}
+
+	// no files, no point
+	if p4fileCount == 0 {
+		errMsg("changelist [%d] has no file records?\n\n", changelist)
+		return p4ExitErrorEmpty, report
+	}
+
+	// pull who / where / when from the header, and attach it to everything logged from here on
+	trigger, ok := parseChangeHeader(p4text[0])
+	if ok {
+		report.User = trigger.User
+		report.Client = trigger.Client
+		zLog = zLog.With(
+			zap.Int("changelist", changelist),
+			zap.String("user", trigger.User),
+			zap.String("client", trigger.Client),
+			zap.String("timestamp", trigger.Timestamp),
+		)
+	} else {
+		zLog.Warn("header", zap.String("unparsed", p4text[0]))
+	}
+
+	// a circuit breaker for bulk imports; tens of thousands of files would mean minutes of fstat calls, so rather
+	// than hold the submit up that long the changelist is let through unchecked
+	if AppConfig.MaxFilesPerChangelist > 0 && p4fileCount > AppConfig.MaxFilesPerChangelist {
+		zLog.Warn("bypassed", zap.Int("files", p4fileCount), zap.Int("max-files", AppConfig.MaxFilesPerChangelist))
+		if AppConfig.JSONOutput {
+			printJSONReport(true, problemList{})
+		} else {
+			errMsg("changelist has %d files, more than max_files_per_changelist (%d); not validated\n\n", p4fileCount, AppConfig.MaxFilesPerChangelist)
+		}
+		report.Bypassed = true
+		return p4ExitSuccess, report
+	}
+
+	// known service accounts (import bots, migration scripts) can skip validation entirely
+	if ok {
+		for _, bypassUser := range AppConfig.BypassUsers {
+			if trigger.User == bypassUser {
+				printBypassed()
+				zLog.Info("bypassed", zap.String("bypass-user", trigger.User))
+				report.Bypassed = true
+				return p4ExitBypass, report
+			}
+		}
+	}
+
+	// with required_groups set, only members of those groups are validated; anyone else's changelist is let
+	// through. if the groups can't be fetched we err on the side of validating
+	if ok && len(AppConfig.RequiredGroups) > 0 {
+		groups, err := userGroups(ctx, runner, trigger.User)
+		if err != nil {
+			zLog.Warn("groups", zap.String("user", trigger.User), zap.Error(err))
+		} else {
+			inRequiredGroup := false
+			for _, group := range groups {
+				for _, requiredGroup := range AppConfig.RequiredGroups {
+					if group == requiredGroup {
+						inRequiredGroup = true
+					}
+				}
+			}
+			if !inRequiredGroup {
+				zLog.Info("NotInRequiredGroups", zap.Strings("groups", groups))
+				if !AppConfig.JSONOutput {
+					fmt.Fprintln(output, "success")
+				} else {
+					printJSONReport(true, problemList{})
+				}
+				return p4ExitSuccess, report
+			}
+		}
 	}
 
-	// no files, no point
-	if p4fileCount == 0 {
-		fmt.Printf("[p4unity] changelist [%d] has no file records?\n\n", changelist)
-		return p4ExitErrorEmpty
+	// look through the commit message; if we have any magic words to bypass this check, abort early. the line
+	// that did it is logged with its index in p4lines - the -s form rebuilt from the describe record, where the
+	// description starts at line 2 after the header and a blank - rather than anything in p4's own output
+	bypassPhrases := AppConfig.BypassPhrases()
+	var bypassCodes []string
+	if AppConfig.BypassHMACSecret != "" {
+		bypassCodes = bypassHMACCodes(AppConfig.BypassHMACSecret, time.Duration(AppConfig.BypassHMACWindowMinutes)*time.Minute, time.Now())
+	}
+	for _, line := range filterStringsByTypeIndexed(p4lines, "text:")[1:] {
+		for _, phrase := range bypassPhrases {
+			if strings.Contains(line.Value, phrase) {
+				printBypassed()
+				zLog.Info("bypassed", zap.String("phrase", phrase), zap.Int("line", line.Index), zap.String("text", line.Value))
+				report.Bypassed = true
+				return p4ExitBypass, report
+			}
+		}
+		if compiledBypassRegex != nil && compiledBypassRegex.MatchString(line.Value) {
+			printBypassed()
+			zLog.Info("bypassed", zap.String("regex", compiledBypassRegex.String()), zap.Int("line", line.Index), zap.String("text", line.Value))
+			report.Bypassed = true
+			return p4ExitBypass, report
+		}
+		for _, code := range bypassCodes {
+			if strings.Contains(line.Value, code) {
+				printBypassed()
+				zLog.Info("bypassed", zap.String("hmac", "valid code"), zap.Int("line", line.Index))
+				report.Bypassed = true
+				return p4ExitBypass, report
+			}
+		}
 	}
 
-	// look through the commit message; if we have any magic words to bypass this check, abort early
-	for i := 1; i < p4headerLines; i++ {
-		if strings.Contains(p4text[i], AppConfig.BypassKeyphrase) {
-			fmt.Printf("[p4unity] bypassing validation\n\n")
-			zLog.Info("bypassed")
-			return p4ExitBypass
+	// optionally, note any files the changelist still has open; a trigger firing on an incomplete changelist is
+	// worth an admin knowing about, though it never blocks. a changelist is always pending while change-content
+	// runs, but someone checking a pending changelist by hand would always find its files open, so that's left alone
+	if AppConfig.CheckOpenedFiles {
+		if runByHand && strings.Contains(p4text[0], "*pending*") {
+			zLog.Info("Opened", zap.String("skipped", "pending changelist, run by hand"))
+		} else if openedFiles, err := openedFilesInChangelist(ctx, runner, changelist); err != nil {
+			zLog.Warn("Opened", zap.Error(err))
+		} else if len(openedFiles) > 0 {
+			zLog.Warn("Opened", zap.Int("count", len(openedFiles)), zap.Strings("files", openedFiles))
 		}
 	}
 
+	// the *IgnoringCase sets mirror their counterparts with lowered paths, so a twin that differs only by case
+	// still counts as present; on a case-sensitive depot they are left empty
 	filesBeingAdded := make(stringSet)
 	filesBeingAddedIgnoringCase := make(stringSet)
 	filesBeingDeleted := make(stringSet)
 	filesBeingDeletedIgnoringCase := make(stringSet)
+	filesBeingSpecialDeleted := make(stringSet)
+	filesBeingEdited := make(stringSet)
+	filesMoveAdd := make(stringSet)
+	filesValidated := make(stringSet)
+	filesMoveDelete := make(stringSet)
 
 	for pi := 0; pi < p4fileCount; pi++ {
 
@@ -275,82 +1612,175 @@ func app() int {
 		// we expect 4 groups; [all], [file], [revision], [operation]
 		// it would be a serious error if our regex can't process something, so flag it up
 		if len(matches) != 4 {
-			fmt.Printf("[p4unity] file parse failed for '%s'\n\n", item)
-			return p4ExitErrorException
+			errMsg("file parse failed for '%s'\n\n", item)
+			return p4ExitErrorException, report
 		}
 
 		filePath := matches[1]
 		vcsOperation := matches[3]
 		itemDirectory, itemFilename := filepath.Split(filePath)
 
+		// every directory check below works from the same form; no matter how p4 presented it, one trailing slash
+		itemDirectory = normalizePath(itemDirectory) + "/"
+
 		// create logging structure for this item
 		itemLog := zLog.With(zap.String("original-spec", item))
 
 		// log the entry as all the bits we've cut it into
-		itemLog.Info("Candidate",
+		itemLog.Debug("Candidate",
 			zap.Strings("elements", matches),
 			zap.Int("index", pi),
 			zap.String("dir-part", itemDirectory),
 			zap.String("file-part", itemFilename),
 		)
 
-		// a directory that terminates with a ~ should be ignored; everything within will not be treated as imported assets
-		if strings.Contains(itemDirectory, "~/") {
-			itemLog.Info("TildeIgnored")
-			continue
-		}
-
-		// ignore .p4ignore, .tests.json et al
-		if strings.HasPrefix(itemFilename, ".") {
-			itemLog.Info("DotIgnored")
+		if !shouldValidateFile(itemDirectory, itemFilename, itemLog) {
 			continue
 		}
 
-		// check the whitelist to see if we should be looking at this file at all
-		pathIsValidToCheck := false
-		for _, whitelist := range AppConfig.PathWhitelist {
-			if strings.HasPrefix(itemDirectory, whitelist) {
-				itemLog.Info("Whitelist", zap.String("passed", whitelist))
-				pathIsValidToCheck = true
-				break
-			}
-		}
-		if !pathIsValidToCheck {
-			itemLog.Info("Whitelist-Failed")
-			continue
+		// in strict mode, an operation we don't know about could be hiding anything
+		if AppConfig.StrictMode && !opsAdd.has(vcsOperation) && !opsDel.has(vcsOperation) && !opsSpecialDelete.has(vcsOperation) && !opsEdit.has(vcsOperation) && !opsUnchecked.has(vcsOperation) {
+			errMsg("unrecognised operation '%s' for '%s' (strict_mode)\n", vcsOperation, filePath)
+			return p4ExitErrorException, report
 		}
 
-		// this is a shitty vague way of only apply rules to the inside of Unity assets folders
-		// TBD: maybe either explicitly use a path list .. or something else, like fstat'ing a sibling path of "/Packages/" for example
-		if strings.Contains(itemDirectory, "/Assets/") == false {
-			itemLog.Info("AssetsPath-Failed")
-			continue
-		}
+		// everything making it this far is subject to validation
+		filesValidated.add(filePath)
 
 		// group files by operation
 		if opsAdd.has(vcsOperation) {
-			itemLog.Info("MarkedForAdd")
+			itemLog.Debug("MarkedForAdd")
 			filesBeingAdded.add(filePath)
-			filesBeingAddedIgnoringCase.add(strings.ToLower(filePath))
+			if !AppConfig.CaseSensitiveDepot {
+				filesBeingAddedIgnoringCase.add(strings.ToLower(filePath))
+			}
 		}
 		if opsDel.has(vcsOperation) {
-			itemLog.Info("MarkedForDelete")
+			itemLog.Debug("MarkedForDelete")
 			filesBeingDeleted.add(filePath)
-			filesBeingDeletedIgnoringCase.add(strings.ToLower(filePath))
+			if !AppConfig.CaseSensitiveDepot {
+				filesBeingDeletedIgnoringCase.add(strings.ToLower(filePath))
+			}
+		}
+		if opsSpecialDelete.has(vcsOperation) {
+			itemLog.Debug("MarkedForSpecialDelete")
+			filesBeingSpecialDeleted.add(filePath)
+		}
+		if opsEdit.has(vcsOperation) {
+			itemLog.Debug("MarkedForEdit")
+			filesBeingEdited.add(filePath)
+		}
+
+		// moves are also tracked by side, so asset and .meta can be paired up below
+		switch vcsOperation {
+		case "move/add":
+			filesMoveAdd.add(filePath)
+		case "move/delete":
+			filesMoveDelete.add(filePath)
 		}
 	}
 
+	zLog.Info("FileSets",
+		zap.Any("add", filesBeingAdded),
+		zap.Any("del", filesBeingDeleted),
+		zap.Any("edit", filesBeingEdited),
+		zap.Any("special-del", filesBeingSpecialDeleted),
+	)
+
 	allowCommitToContinue := true
+	var problems problemList
+	if trigger.User != "" {
+		problems.submitter = fmt.Sprintf("Change %d by %s@%s", trigger.Changelist, trigger.User, trigger.Client)
+	}
+	if AppConfig.IncludeChangeDescription || markdownOutput() {
+		problems.description = changeDescription(p4text, AppConfig.DescriptionMaxLines)
+	}
+
+	// tallied for the summary line, which makes it into the rejection email alongside the per-file errors
+	filesChecked := 0
+	problemsFound := 0
+
+	// --------------------------------------------------------
+	// gather up every twin that isn't part of this changelist; these need checking against the depot, which
+	// we do up-front in batches spread across a few workers rather than launching p4 for each file in turn
+	depotQueries := make(stringSet)
+	// with skip_fstat_on_add, an added file's twin has to be in the changelist; left out of the queries, it
+	// reads as not in the depot below
+	if !AppConfig.SkipFstatOnAdd {
+		for fadd := range filesBeingAdded {
+			if filepath.Ext(fadd) != ".meta" && !assetRequiresMeta(fadd) {
+				continue
+			}
+			twin := metaTwinPath(fadd)
+			if twin != "" && !filesBeingAdded.has(twin) && !filesBeingAddedIgnoringCase.has(strings.ToLower(twin)) {
+				depotQueries.add(twin)
+			}
+		}
+	}
+	// likewise with skip_fstat_on_delete, where a deleted file's twin is assumed to still be in the depot
+	if !AppConfig.SkipFstatOnDelete {
+		for fdel := range filesBeingDeleted {
+			twin := metaTwinPath(fdel)
+			if twin != "" && !filesBeingDeleted.has(twin) && !filesBeingDeletedIgnoringCase.has(strings.ToLower(twin)) && !filesBeingSpecialDeleted.has(twin) {
+				depotQueries.add(twin)
+			}
+		}
+	}
+
+	for fedit := range filesBeingEdited {
+		if filepath.Ext(fedit) == ".meta" || !assetRequiresMeta(fedit) {
+			continue
+		}
+		twin := metaTwinPath(fedit)
+		if !filesBeingEdited.has(twin) && !filesBeingAdded.has(twin) && !filesBeingAddedIgnoringCase.has(strings.ToLower(twin)) {
+			depotQueries.add(twin)
+		}
+	}
+
+	depotQueryPaths := make([]string, 0, len(depotQueries))
+	for depotPath := range depotQueries {
+		depotQueryPaths = append(depotQueryPaths, depotPath)
+	}
+
+	zLog.Info("Checking depot", zap.Int("count", len(depotQueryPaths)), zap.Int("workers", AppConfig.WorkerCount))
+	fstatStart := time.Now()
+	existsInDepot, err := fileExistsInDepotParallel(ctx, runner, depotQueryPaths, changelist, AppConfig.WorkerCount)
+	timings.fstat = time.Since(fstatStart)
+	if err != nil {
+		errMsg("fstat failed\n( %s )\n", err)
+		return p4FailureExit(ctx, p4ExitErrorException), report
+	}
+
+	// a path that was asked about but has no answer timed out (see fstat_timeout_seconds); it isn't checked
+	depotTimedOut := func(depotPath string) bool {
+		_, answered := existsInDepot[depotPath]
+		if depotQueries.has(depotPath) && !answered {
+			zLog.Warn("Unchecked", zap.String("path", depotPath), zap.String("reason", "fstat timed out"))
+			return true
+		}
+		return false
+	}
 
 	// --------------------------------------------------------
 	zLog.Info("Checking ADD list", zap.Int("count", len(filesBeingAdded)))
+	addStart := time.Now()
 	for fadd := range filesBeingAdded {
 
+		if problems.suppressed {
+			break
+		}
+		filesChecked++
+
 		fileExtension := filepath.Ext(fadd)
 
 		// file is an asset; check to see if there's a .meta accompaniment
 		if fileExtension != ".meta" {
 
+			// .. if it's the kind of asset that needs one
+			if !assetRequiresMeta(fadd) {
+				continue
+			}
+
 			fileWithMeta := fadd + ".meta"
 
 			// is the meta file coming in this changelist? that's nice
@@ -363,18 +1793,18 @@ func app() int {
 			}
 
 			// if it's not in the changelist, is it already in the depot at time of commit?
-			foundInDepot, err := fileExistsInDepot(fileWithMeta)
-			if err != nil {
-				fmt.Printf("[p4unity] fstat failed for '%s'\n( %s )\n", fileWithMeta, err)
-				return p4ExitErrorException
+			foundInDepot := existsInDepot[fileWithMeta]
+			if foundInDepot || depotTimedOut(fileWithMeta) {
+				continue
 			}
 
-			if foundInDepot {
+			if pathIsBypassed(fadd) {
 				continue
 			}
-
-			fmt.Printf("Missing .meta file for '%s'\n", fadd)
-			allowCommitToContinue = false
+			if problems.report(fadd, problemMissingMeta, fmt.Sprintf("Missing .meta file for '%s'", fadd)) {
+				allowCommitToContinue = false
+				problemsFound++
+			}
 
 		} else {
 			// .. otherwise, it's a meta file; see if we can determine if it represents a directory or an asset
@@ -384,7 +1814,32 @@ func app() int {
 			// removing extension again can indicate if this is a meta for a directory (or, technically, an extensionless asset, but whatchagondo)
 			remainingExtension := strings.TrimSpace(filepath.Ext(fileWithoutMeta))
 			if len(remainingExtension) == 0 {
-				// there's no matching P4 entry for a directory, so we have to just assume and let this pass
+				// there's no matching P4 entry for a directory, so unless asked to go looking we just assume and let this pass
+				if !AppConfig.RequireMetaForDirectories {
+					continue
+				}
+
+				// files are being added inside it, so it'll exist soon enough
+				if filesBeingAdded.hasPrefix(fileWithoutMeta + "/") {
+					continue
+				}
+
+				foundInDepot, err := directoryExistsInDepot(ctx, runner, fileWithoutMeta, changelist)
+				if err != nil {
+					errMsg("dirs failed for '%s'\n( %s )\n", fileWithoutMeta, err)
+					return p4FailureExit(ctx, p4ExitErrorException), report
+				}
+				if foundInDepot {
+					continue
+				}
+
+				if pathIsBypassed(fadd) {
+					continue
+				}
+				if problems.report(fadd, problemMissingDirectory, fmt.Sprintf("Missing directory for .meta file '%s'", fadd)) {
+					allowCommitToContinue = false
+					problemsFound++
+				}
 				continue
 			}
 
@@ -398,33 +1853,99 @@ func app() int {
 			}
 
 			// if it's not in the changelist, is it already in the depot at time of commit?
-			foundInDepot, err := fileExistsInDepot(fileWithoutMeta)
+			foundInDepot := existsInDepot[fileWithoutMeta]
+			if foundInDepot || depotTimedOut(fileWithoutMeta) {
+				continue
+			}
+
+			if pathIsBypassed(fadd) {
+				continue
+			}
+			if problems.report(fadd, problemMissingAsset, fmt.Sprintf("Missing asset for .meta file '%s' - submit '%s' in the same changelist or ensure it already exists in the depot", fadd, fileWithoutMeta)) {
+				allowCommitToContinue = false
+				problemsFound++
+			}
+		}
+	}
+
+	timings.addChecks = time.Since(addStart)
+
+	// --------------------------------------------------------
+	// optionally, crack open each incoming .meta and make sure it carries a sensible GUID
+	if AppConfig.ValidateMetaGUID {
+		zLog.Info("Checking GUIDs")
+		for fadd := range filesBeingAdded {
+
+			if problems.suppressed {
+				break
+			}
+
+			if filepath.Ext(fadd) != ".meta" {
+				continue
+			}
+
+			guid, err := metaGUIDInChangelist(ctx, runner, fadd, changelist)
 			if err != nil {
-				fmt.Printf("[p4unity] fstat failed for '%s'\n( %s )\n", fileWithoutMeta, err)
-				return p4ExitErrorException
+				errMsg("print failed for '%s'\n( %s )\n", fadd, err)
+				return p4FailureExit(ctx, p4ExitErrorException), report
+			}
+
+			if guid == "" {
+				if problems.report(fadd, problemInvalidGUID, fmt.Sprintf("Missing or malformed guid in .meta file '%s'", fadd)) {
+					allowCommitToContinue = false
+					problemsFound++
+				}
+			}
+		}
+	}
+
+	// --------------------------------------------------------
+	// optionally, check no incoming .meta is empty; it passes the twin checks above, but unity can't use it
+	if AppConfig.ValidateMetaSize {
+		zLog.Info("Checking .meta sizes")
+		for fadd := range filesBeingAdded {
+
+			if problems.suppressed {
+				break
 			}
 
-			if foundInDepot {
+			if filepath.Ext(fadd) != ".meta" {
 				continue
 			}
 
-			fmt.Printf("Missing asset for .meta file '%s'\n", fadd)
-			allowCommitToContinue = false
+			metaSize, err := fileSizeInChangelist(ctx, runner, fadd, changelist)
+			if err != nil {
+				errMsg("fstat failed for '%s'\n( %s )\n", fadd, err)
+				return p4FailureExit(ctx, p4ExitErrorException), report
+			}
+
+			if metaSize == 0 {
+				if problems.report(fadd, problemEmptyMeta, fmt.Sprintf("Zero-byte .meta file added: %s", fadd)) {
+					allowCommitToContinue = false
+					problemsFound++
+				}
+			}
 		}
 	}
 
 	// --------------------------------------------------------
 	zLog.Info("Checking DEL list", zap.Int("count", len(filesBeingDeleted)))
+	delStart := time.Now()
 	for fdel := range filesBeingDeleted {
 
+		if problems.suppressed {
+			break
+		}
+		filesChecked++
+
 		fileExtension := filepath.Ext(fdel)
 
 		if fileExtension != ".meta" {
 
 			fileWithMeta := fdel + ".meta"
 
-			// file's twin is being deleted as part of this CL, all is well
-			if filesBeingDeleted.has(fileWithMeta) {
+			// file's twin is being deleted (or purged) as part of this CL, all is well
+			if filesBeingDeleted.has(fileWithMeta) || filesBeingSpecialDeleted.has(fileWithMeta) {
 				continue
 			}
 			// in ignore-case mode, also check the lowered list
@@ -432,52 +1953,358 @@ func app() int {
 				continue
 			}
 
-			// if the meta isn't being deleted now, maybe it's already deleted (and we're tidying up)
-			foundInDepot, err := fileExistsInDepot(fileWithMeta)
+			// if the meta isn't being deleted now, maybe it's already deleted (and we're tidying up); unless we're
+			// not asking, in which case it's assumed to still be there
+			if !AppConfig.SkipFstatOnDelete && !existsInDepot[fileWithMeta] {
+				continue
+			}
+
+			if pathIsBypassed(fdel) {
+				continue
+			}
+			if problems.report(fdel, problemOrphanedMeta, fmt.Sprintf("Need to delete the orphaned .meta for '%s'", fdel)) {
+				allowCommitToContinue = false
+				problemsFound++
+			}
+
+		} else {
+
+			// a .meta on its own is just as broken the other way round; the asset left behind would have no .meta
+			fileWithoutMeta := metaTwinPath(fdel)
+
+			// directory .meta, there's no depot entry for the directory to leave behind
+			if fileWithoutMeta == "" {
+				continue
+			}
+
+			// asset is going too, all is well
+			if filesBeingDeleted.has(fileWithoutMeta) || filesBeingSpecialDeleted.has(fileWithoutMeta) {
+				continue
+			}
+			// in ignore-case mode, also check the lowered list
+			if filesBeingDeletedIgnoringCase.has(strings.ToLower(fileWithoutMeta)) {
+				continue
+			}
+
+			// if the asset isn't in the depot either, there's nothing to orphan
+			if !AppConfig.SkipFstatOnDelete && !existsInDepot[fileWithoutMeta] {
+				continue
+			}
+
+			if pathIsBypassed(fdel) {
+				continue
+			}
+			if problems.report(fdel, problemOrphanedAsset, fmt.Sprintf("Deleting .meta without deleting asset: '%s'", fileWithoutMeta)) {
+				allowCommitToContinue = false
+				problemsFound++
+			}
+		}
+
+	}
+
+	// purged and archived files only lose their content, so one going without its twin is logged but never blocks
+	for fspecial := range filesBeingSpecialDeleted {
+		filesChecked++
+
+		twin := metaTwinPath(fspecial)
+		if twin == "" || filesBeingSpecialDeleted.has(twin) || filesBeingDeleted.has(twin) {
+			continue
+		}
+		zLog.Warn("SpecialDelete", zap.String("file", fspecial), zap.String("twin-remains", twin))
+	}
+	timings.delChecks = time.Since(delStart)
+
+	// --------------------------------------------------------
+	zLog.Info("Checking EDIT list", zap.Int("count", len(filesBeingEdited)))
+	for fedit := range filesBeingEdited {
+
+		if problems.suppressed {
+			break
+		}
+		filesChecked++
+
+		fileExtension := filepath.Ext(fedit)
+
+		// an asset being modified should still have its .meta in the depot; it can go missing if it was
+		// obliterated, or deleted while validation was bypassed
+		if fileExtension != ".meta" {
+
+			if !assetRequiresMeta(fedit) {
+				continue
+			}
+
+			fileWithMeta := fedit + ".meta"
+
+			// meta is also being edited, or (re)added, in this changelist
+			if filesBeingEdited.has(fileWithMeta) || filesBeingAdded.has(fileWithMeta) {
+				continue
+			}
+			// in ignore-case mode, also check the lowered list
+			if filesBeingAddedIgnoringCase.has(strings.ToLower(fileWithMeta)) {
+				continue
+			}
+
+			foundInDepot := existsInDepot[fileWithMeta]
+			if foundInDepot || depotTimedOut(fileWithMeta) {
+				continue
+			}
+
+			if problems.report(fedit, problemEditMissingMeta, fmt.Sprintf("Missing .meta file for edited '%s'", fedit)) {
+				allowCommitToContinue = false
+				problemsFound++
+			}
+		}
+	}
+
+	// --------------------------------------------------------
+	// optionally, make sure an edited .meta keeps the GUID it had; a changed GUID silently breaks every scene
+	// and prefab reference to the asset. while change-content runs the new revision isn't yet the head, so
+	// #head is the one being replaced
+	if AppConfig.RequireConsistentGUID {
+		zLog.Info("Checking edited GUIDs")
+		for fedit := range filesBeingEdited {
+
+			if problems.suppressed {
+				break
+			}
+
+			if filepath.Ext(fedit) != ".meta" {
+				continue
+			}
+
+			previousGUID, err := metaGUIDAt(ctx, runner, fedit+"#head")
+			if err != nil {
+				errMsg("print failed for '%s'\n( %s )\n", fedit, err)
+				return p4FailureExit(ctx, p4ExitErrorException), report
+			}
+			// nothing sensible to compare against
+			if previousGUID == "" {
+				continue
+			}
+
+			guid, err := metaGUIDInChangelist(ctx, runner, fedit, changelist)
 			if err != nil {
-				fmt.Printf("[p4unity] fstat failed for '%s'\n( %s )\n", fdel, err)
-				return p4ExitErrorException
+				errMsg("print failed for '%s'\n( %s )\n", fedit, err)
+				return p4FailureExit(ctx, p4ExitErrorException), report
+			}
+
+			if guid != previousGUID {
+				if guid == "" {
+					guid = "none"
+				}
+				if problems.report(fedit, problemGUIDChanged, fmt.Sprintf("Edited .meta file '%s' changes its guid from %s to %s; every reference to the asset would break", fedit, previousGUID, guid)) {
+					allowCommitToContinue = false
+					problemsFound++
+				}
+			}
+		}
+	}
+
+	// --------------------------------------------------------
+	// a move is recorded as a move/add at the destination and a move/delete at the source; the asset and its
+	// .meta should make the journey together, so check each side of the move pairs up
+	zLog.Info("Checking MOVE pairs", zap.Int("add", len(filesMoveAdd)), zap.Int("delete", len(filesMoveDelete)))
+	for _, filesMoved := range []stringSet{filesMoveAdd, filesMoveDelete} {
+
+		filesMovedIgnoringCase := make(stringSet)
+		if !AppConfig.CaseSensitiveDepot {
+			for fmove := range filesMoved {
+				filesMovedIgnoringCase.add(strings.ToLower(fmove))
+			}
+		}
+
+		for fmove := range filesMoved {
+
+			if problems.suppressed {
+				break
 			}
 
-			if !foundInDepot {
+			twin := metaTwinPath(fmove)
+
+			// directory .meta, or both halves are moving together
+			if twin == "" || filesMoved.has(twin) || filesMovedIgnoringCase.has(strings.ToLower(twin)) {
+				continue
+			}
+			if filepath.Ext(fmove) != ".meta" && !assetRequiresMeta(fmove) {
 				continue
 			}
 
-			fmt.Printf("Need to delete the orphaned .meta for '%s'\n", fdel)
-			allowCommitToContinue = false
+			blocking := false
+			if filepath.Ext(fmove) != ".meta" {
+				blocking = problems.report(fmove, problemMoveMissingMeta, fmt.Sprintf("Moved '%s' without moving its .meta", fmove))
+			} else {
+				blocking = problems.report(fmove, problemMoveMissingAsset, fmt.Sprintf("Moved .meta file '%s' without moving its asset", fmove))
+			}
+			if blocking {
+				allowCommitToContinue = false
+				problemsFound++
+			}
+		}
+	}
+
+	// in markdown mode a rejection is written out as one document below, in place of the lines printed so far
+	markdownRejection := markdownOutput() && (len(problems.items) > 0 || len(problems.warnings) > 0)
 
-		} else {
+	if problems.suppressed && !AppConfig.JSONOutput && !markdownRejection {
+		fmt.Fprintln(output, "... and more errors were suppressed")
+	}
+
+	zLog.Info("Summary", zap.Int("filesChecked", filesChecked), zap.Int("problemsFound", problemsFound))
+	if !AppConfig.JSONOutput && !markdownRejection {
+		errMsg("checked %d files: %d problems found\n", filesChecked, problemsFound)
+	}
+
+	if AppConfig.JSONOutput {
+		printJSONReport(allowCommitToContinue, problems)
+	}
+	if markdownRejection {
+		printMarkdownReport(problems, filesChecked, problemsFound)
+	}
+
+	if AppConfig.XMLReportFile != "" {
+		if err := writeJUnitReport(AppConfig.XMLReportFile, changelist, filesValidated, problems); err != nil {
+			zLog.Warn("JUnit", zap.String("file", AppConfig.XMLReportFile), zap.Error(err))
+			errMsg("could not write XML report '%s'; %s\n", AppConfig.XMLReportFile, err)
+		}
+	}
 
-			// fileWithoutMeta := fdel[0 : len(fdel)-len(".meta")]
-			// TBD
+	// notification is a sideline; a webhook that fails is logged, but never changes the outcome
+	if AppConfig.ReportWebhookURL != "" {
+		err := postWebhookReport(AppConfig.ReportWebhookURL, webhookReport{
+			Changelist: changelist,
+			User:       trigger.User,
+			Client:     trigger.Client,
+			Allowed:    allowCommitToContinue || dryRun || AppConfig.WarnOnly || AppConfig.Simulate,
+			Problems:   problems.items,
+		})
+		if err != nil {
+			zLog.Warn("Webhook", zap.Error(err))
 		}
+	}
+
+	if AppConfig.StatsCounterPrefix != "" {
+		recordStats(ctx, runner, AppConfig.StatsCounterPrefix, filesChecked, problemsFound)
+	}
 
+	report.FilesChecked = filesChecked
+	for _, problem := range problems.items {
+		report.ProblemsFound = append(report.ProblemsFound, problem.Message)
 	}
 
 	if allowCommitToContinue {
-		fmt.Println("success")
-		return p4ExitSuccess
+		if !AppConfig.JSONOutput {
+			fmt.Fprintln(output, "success")
+		}
+		return p4ExitSuccess, report
+	}
+
+	// in a dry run, or warn-only mode, the problems have been printed but nothing is blocked
+	if dryRun {
+		zLog.Info("DryRun", zap.Int("problems", len(problems.items)))
+		return p4ExitSuccess, report
 	}
+	if AppConfig.WarnOnly {
+		zLog.Info("WarnOnly", zap.Int("problems", len(problems.items)))
+		report.WarnOnly = true
+		return p4ExitSuccess, report
+	}
+
+	return p4ExitProblems, report
+}
 
-	return p4ExitProblems
+// ----------------------------------------------------------------------------------------------------------
+// the changelist comes from the command line, or failing that from the environment
+func changelistArgument() string {
+	if flag.NArg() >= 1 {
+		return flag.Arg(0)
+	}
+	return os.Getenv("P4U_CHANGELIST")
 }
 
 // ----------------------------------------------------------------------------------------------------------
 func main() {
+	os.Exit(run())
+}
+
+// run does all the work of main, returning the exit code; os.Exit skips deferred calls, so it's left to main
+func run() int {
 
 	perfStart := time.Now()
 
-	LoadConfig()
+	// flags must come before the changelist argument, eg. p4unity -config Z:\p4unity.toml %changelist%
+	configFlag := flag.String("config", "", "path to the p4unity toml (or .yaml) config file (default p4unity.toml, or P4U_CONFIG)")
+	dryRunFlag := flag.Bool("dry-run", false, "run all validation and report problems, but always allow the commit (or P4U_DRYRUN=1)")
+	versionFlag := flag.Bool("version", false, "print the build version and exit")
+	explainFlag := flag.Bool("explain", false, "describe what p4unity checks and why, then exit")
+	describeFileFlag := flag.String("describe-file", "", "read the changelist from saved 'p4 -G describe -s' output (or -ztag, with use_ztag_output) instead of running p4 describe")
+	flag.Parse()
+
+	// answered before the config is loaded, so they work without a toml present
+	if *versionFlag {
+		fmt.Printf("p4unity version %s (built %s %s)\n", Version, BuildDate, BuildCommit)
+		return p4ExitSuccess
+	}
+	if *explainFlag {
+		printExplanation()
+		return p4ExitSuccess
+	}
+	if flag.Arg(0) == "init" {
+		return initConfig(flag.Args()[1:])
+	}
+
+	dryRunEnv, _ := parseEnvBool(os.Getenv("P4U_DRYRUN"))
+	dryRun = *dryRunFlag || dryRunEnv
+	describeFile = *describeFileFlag
+	runByHand = describeFile != "" || stdinIsTerminal()
+
+	configPath := ConfigPath(*configFlag)
+	LoadConfig(configPath)
+
+	if outputFile := initOutput(); outputFile != nil {
+		defer outputFile.Close()
+	}
+
+	// bound the whole run, so a struggling p4 server can't leave the trigger (and the submit) hanging forever
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if AppConfig.OverallTimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(AppConfig.OverallTimeoutSeconds)*time.Second)
+	}
+	defer cancel()
+
+	// every p4 query goes through this, from here on
+	runner := RealP4Runner{}
+
+	// `p4unity health` checks the deployment rather than a changelist, and reports on the log directory itself
+	if flag.Arg(0) == "health" {
+		zLog = zap.NewNop()
+		return healthCheck(ctx, runner, configPath)
+	}
+
+	// `p4unity check-config` tries out a config file before it's deployed
+	if flag.Arg(0) == "check-config" {
+		zLog = zap.NewNop()
+		return checkConfig(ctx, runner, configPath)
+	}
 
 	if AppConfig.VerboseLogs {
 
 		// spin up a log
 		var err error
-		zLog, err = VerboseLogger()
+		zLog, err = VerboseLogger(changelistArgument())
 		if err != nil {
 			log.Panicf("[p4unity] could not open log\n( %s )\n", err)
 		}
 
+		// check (and record) what we're talking to, rather than failing obscurely at the first describe
+		if !checkP4Connectivity(ctx, runner) {
+			errMsg("cannot connect to perforce server '%s'; check perforce_server (P4U_SERVER), perforce_proxy (P4U_PROXY) and that p4 is on the PATH\n\n", AppConfig.P4Port())
+			return p4ExitErrorException
+		}
+
+		if AppConfig.PerforceTicketFile == "" && AppConfig.PerforcePassFile == "" && AppConfig.PerforcePass != "" {
+			zLog.Warn("Credentials", zap.String("warning", "using plaintext perforce_pass; consider perforce_ticket_file or perforce_pass_file instead"))
+		}
+
 	} else {
 
 		// log to the void
@@ -485,10 +2312,47 @@ func main() {
 
 	}
 
-	exitCode := app()
+	// catch bad or expired credentials up front, rather than as a confusing failure part-way through validation
+	if AppConfig.ValidateCredentialsOnStart {
+		if loginOut, ok := checkP4Login(ctx, runner); !ok {
+			zLog.Warn("Credentials", zap.String("user", AppConfig.PerforceUser), zap.String("output", loginOut))
+			errMsg("perforce rejected the credentials for '%s'; check perforce_pass, perforce_pass_file or perforce_ticket_file\n( %s )\n\n", AppConfig.PerforceUser, loginOut)
+			return p4ExitErrorException
+		}
+	}
+
+	// whitelisted labels are resolved to directories once, up front, rather than asking p4 about them per file
+	if AppConfig.PreloadLabels && len(AppConfig.LabelWhitelist) > 0 {
+		if err := loadLabelWhitelist(ctx, runner); err != nil {
+			errMsg("failed to load label_whitelist; %s\n\n", err)
+			return p4FailureExit(ctx, p4ExitErrorException)
+		}
+	}
+
+	// `p4unity list-orphans <path>` audits what's already in the depot, instead of checking a changelist
+	var exitCode int
+	if flag.Arg(0) == "list-orphans" {
+		exitCode = listOrphans(ctx, runner, flag.Arg(1))
+	} else {
+		var appReport AppReport
+		exitCode, appReport = app(ctx, runner)
+
+		// simulation never blocks, whatever app() made of the changelist - even a failure to talk to p4
+		if AppConfig.Simulate && exitCode != p4ExitSuccess {
+			zLog.Info("Simulate", zap.Int("exit-code", exitCode))
+			exitCode = p4ExitSuccess
+		}
+
+		if AppConfig.AuditLogFile != "" {
+			if err := appendAuditLog(AppConfig.AuditLogFile, appReport, exitCode == p4ExitSuccess); err != nil {
+				zLog.Warn("Audit", zap.String("file", AppConfig.AuditLogFile), zap.Error(err))
+				errMsg("could not write audit log '%s'; %s\n", AppConfig.AuditLogFile, err)
+			}
+		}
+	}
 
 	perfElapsed := fmt.Sprintf("%s", time.Since(perfStart))
 	zLog.Info("Performance", zap.String("elapsed", perfElapsed))
 
-	os.Exit(exitCode)
+	return exitCode
 }
@@ -0,0 +1,377 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// useTestConfig puts back the defaults, plus what the shipped p4unity.toml sets that matters here, and clears
+// anything a previous run left behind; output is captured into the returned buffer for the test's duration
+func useTestConfig(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	AppConfig = configDefaults
+	AppConfig.PathWhitelist = []string{"//"}
+	AppConfig.BypassKeyphrase = "p4unity-bypass"
+	AppConfig.CaseSensitiveDepot = true
+
+	zLog = zap.NewNop()
+	depotResultCache.invalidate()
+	dryRun = false
+	describeFile = ""
+	runByHand = false
+
+	var captured bytes.Buffer
+	previousOutput := output
+	output = &captured
+	t.Cleanup(func() { output = previousOutput })
+	return &captured
+}
+
+// testdataRunner loads a testdata/ directory into a MockP4Runner, returning it with the changelist it describes;
+// the describe is marshal'd to match what -G would give unless use_ztag_output is set, and fstat.txt / dirs.txt
+// are split up by depot path so each can be answered on its own
+func testdataRunner(t *testing.T, scenario string) (MockP4Runner, int) {
+	t.Helper()
+
+	readScenarioFile := func(name string) []byte {
+		content, err := ioutil.ReadFile(filepath.Join("testdata", scenario, name))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return content
+	}
+
+	describeOut := readScenarioFile("describe.txt")
+	describeRecords := parseZtagOutput(describeOut)
+	if len(describeRecords) == 0 {
+		t.Fatalf("%s: no describe record", scenario)
+	}
+	changelist, err := strconv.Atoi(describeRecords[0]["change"])
+	if err != nil {
+		t.Fatalf("%s: bad change; %s", scenario, err)
+	}
+
+	runner := MockP4Runner{Responses: make(map[string][]byte)}
+	if AppConfig.UseZtagOutput {
+		runner.Responses["describe "+strconv.Itoa(changelist)] = describeOut
+	} else {
+		runner.Responses["describe "+strconv.Itoa(changelist)] = marshalRecords(describeRecords)
+	}
+
+	// each fstat record opens with its depotFile, and runs until the next one
+	fstatKey := ""
+	for _, line := range strings.SplitAfter(string(readScenarioFile("fstat.txt")), "\n") {
+		if depotFile := reFindDepotFile.FindStringSubmatch(line); len(depotFile) != 0 {
+			fstatKey = "fstat " + strings.TrimSpace(depotFile[1]) + "@" + strconv.Itoa(changelist)
+		}
+		if fstatKey != "" {
+			runner.Responses[fstatKey] = append(runner.Responses[fstatKey], line...)
+		}
+	}
+
+	for _, line := range strings.SplitAfter(string(readScenarioFile("dirs.txt")), "\n") {
+		if strings.HasPrefix(line, "info:") {
+			dirsKey := "dirs " + strings.TrimSpace(strings.TrimPrefix(line, "info:")) + "@" + strconv.Itoa(changelist)
+			runner.Responses[dirsKey] = []byte(line)
+		}
+	}
+
+	return runner, changelist
+}
+
+// editDescribe sets <fields> on the -G describe record a testdataRunner serves for <changelist>
+func editDescribe(t *testing.T, runner MockP4Runner, changelist int, fields map[string]string) {
+	t.Helper()
+
+	describeKey := "describe " + strconv.Itoa(changelist)
+	describeRecords, err := parseMarshalOutput(runner.Responses[describeKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range fields {
+		describeRecords[0][key] = value
+	}
+	runner.Responses[describeKey] = marshalRecords(describeRecords)
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// every changelist in testdata/, with what app() should make of it; see testdata/README.md
+var appScenarios = []struct {
+	scenario string
+	ztag     bool
+	dirMeta  bool
+	exitCode int
+	want     string
+}{
+	{scenario: "clean", exitCode: p4ExitSuccess, want: "success"},
+	{scenario: "missing-meta", exitCode: p4ExitProblems, want: "Missing .meta file for '//Depot/UnityProjects/Thing/Assets/Textures/Rock.png'"},
+	{scenario: "extra-meta", exitCode: p4ExitProblems, want: "Missing asset for .meta file '//Depot/UnityProjects/Thing/Assets/Textures/Moss.png.meta'"},
+	{scenario: "linux-line-endings", exitCode: p4ExitSuccess, want: "success"},
+	{scenario: "deleted-meta", exitCode: p4ExitProblems, want: "Deleting .meta without deleting asset: '//Depot/UnityProjects/Thing/Assets/Textures/Rock.png'"},
+	{scenario: "ztag", ztag: true, exitCode: p4ExitProblems, want: "Missing .meta file for '//Depot/UnityProjects/Thing/Assets/Textures/Rock.png'"},
+	{scenario: "directory-meta", dirMeta: true, exitCode: p4ExitProblems, want: "Missing directory for .meta file '//Depot/UnityProjects/Thing/Assets/Empty.meta'"},
+}
+
+// testAppScenarios runs app() over each of the named testdata/ scenarios, checking the exit code and output
+func testAppScenarios(t *testing.T, scenarios ...string) {
+
+	for _, scenario := range scenarios {
+		found := false
+		for _, tc := range appScenarios {
+			if tc.scenario != scenario {
+				continue
+			}
+			found = true
+
+			t.Run(tc.scenario, func(t *testing.T) {
+				captured := useTestConfig(t)
+				AppConfig.UseZtagOutput = tc.ztag
+				AppConfig.RequireMetaForDirectories = tc.dirMeta
+
+				runner, changelist := testdataRunner(t, tc.scenario)
+				t.Setenv("P4U_CHANGELIST", strconv.Itoa(changelist))
+
+				exitCode, _ := app(context.Background(), runner)
+				if exitCode != tc.exitCode {
+					t.Errorf("exit code %d, want %d\n%s", exitCode, tc.exitCode, captured)
+				}
+				if !strings.Contains(captured.String(), tc.want) {
+					t.Errorf("output is missing %q\n%s", tc.want, captured)
+				}
+			})
+		}
+		if !found {
+			t.Fatalf("no scenario '%s'", scenario)
+		}
+	}
+}
+
+func TestApp_CleanCL(t *testing.T) {
+	testAppScenarios(t, "clean")
+}
+
+func TestApp_MissingMeta(t *testing.T) {
+	testAppScenarios(t, "missing-meta", "ztag")
+}
+
+func TestApp_ExtraMeta(t *testing.T) {
+	testAppScenarios(t, "extra-meta")
+}
+
+func TestApp_LinuxLineEndings(t *testing.T) {
+	testAppScenarios(t, "linux-line-endings")
+}
+
+func TestApp_DeletedMeta(t *testing.T) {
+	testAppScenarios(t, "deleted-meta")
+}
+
+func TestApp_DirectoryMeta(t *testing.T) {
+	testAppScenarios(t, "directory-meta")
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// a p4d on windows ends its lines with \r\n and one on linux with \n; the same output either way has to parse
+// the same, through the -s line filtering and the -ztag records alike
+
+const describeSText = "text: Change 9148 by harry@harry_pc on 2020/04/12 15:32:01\n" +
+	"text: \n" +
+	"text: \tNew rock textures\n" +
+	"text: \n" +
+	"text: Affected files ...\n" +
+	"text: \n" +
+	"info1: //Depot/UnityProjects/Thing/Assets/Textures/Rock.png#1 add\n" +
+	"info1: //Depot/UnityProjects/Thing/Assets/Textures/Rock.png.meta#1 add\n" +
+	"exit: 0\n"
+
+const describeZtagText = "... change 9148\n" +
+	"... user harry\n" +
+	"... desc New rock textures\n" +
+	"\n" +
+	"with a second paragraph\n" +
+	"\n" +
+	"... depotFile0 //Depot/UnityProjects/Thing/Assets/Textures/Rock.png\n" +
+	"... action0 add\n" +
+	"\n"
+
+const fstatSText = "info1: depotFile //Depot/UnityProjects/Thing/Assets/Textures/Moss.png.meta\n" +
+	"info1: headAction add\n" +
+	"info: \n" +
+	"info1: depotFile //Depot/UnityProjects/Thing/Assets/Textures/Old.png.meta\n" +
+	"info1: headAction delete\n" +
+	"info: \n" +
+	"exit: 0\n"
+
+var lineEndings = []struct {
+	name    string
+	newline string
+}{
+	{"LF", "\n"},
+	{"CRLF", "\r\n"},
+}
+
+func TestParse_LineEndings(t *testing.T) {
+
+	for _, le := range lineEndings {
+		t.Run(le.name, func(t *testing.T) {
+			useTestConfig(t)
+
+			// -s describe; the header and each file record, with nothing left trailing on them
+			describeLines := splitP4Lines([]byte(strings.ReplaceAll(describeSText, "\n", le.newline)))
+			header := filterStringsByType(describeLines, "text:")
+			if len(header) != 3 || header[0] != "Change 9148 by harry@harry_pc on 2020/04/12 15:32:01" {
+				t.Errorf("header %q", header)
+			}
+			fileRecords := filterStringsByType(describeLines, "info1:")
+			if len(fileRecords) != 2 {
+				t.Fatalf("file records %q", fileRecords)
+			}
+			for _, record := range fileRecords {
+				matches := reFileRecordUnpack.FindStringSubmatch(record)
+				if len(matches) != 4 || matches[3] != "add" {
+					t.Errorf("record %q unpacked as %q", record, matches)
+				}
+			}
+
+			// -ztag describe
+			records := parseZtagOutput([]byte(strings.ReplaceAll(describeZtagText, "\n", le.newline)))
+			if len(records) != 1 {
+				t.Fatalf("ztag records %v", records)
+			}
+			if records[0]["change"] != "9148" || records[0]["action0"] != "add" {
+				t.Errorf("ztag record %v", records[0])
+			}
+			if records[0]["desc"] != "New rock textures\n\nwith a second paragraph" {
+				t.Errorf("ztag desc %q", records[0]["desc"])
+			}
+
+			// -s fstat, through the depot check
+			runner := MockP4Runner{Responses: map[string][]byte{
+				"fstat //Depot/UnityProjects/Thing/Assets/Textures/Moss.png.meta": []byte(strings.ReplaceAll(fstatSText, "\n", le.newline)),
+			}}
+			existsInDepot, err := fileExistsInDepotBatch(context.Background(), runner, []string{
+				"//Depot/UnityProjects/Thing/Assets/Textures/Moss.png.meta",
+				"//Depot/UnityProjects/Thing/Assets/Textures/Old.png.meta",
+			}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !existsInDepot["//Depot/UnityProjects/Thing/Assets/Textures/Moss.png.meta"] || existsInDepot["//Depot/UnityProjects/Thing/Assets/Textures/Old.png.meta"] {
+				t.Errorf("fstat found %v", existsInDepot)
+			}
+		})
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// a depot whose fstat never answers in time; the checks that needed it are skipped, rather than failed
+
+type slowFstatRunner struct {
+	MockP4Runner
+}
+
+func (r slowFstatRunner) Fstat(ctx context.Context, fileSpecs []string, fields string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestApp_FstatTimeout(t *testing.T) {
+	captured := useTestConfig(t)
+	AppConfig.FstatTimeoutSeconds = 1
+
+	// Moss.png's .meta is only in the depot, which can't be asked
+	runner, changelist := testdataRunner(t, "clean")
+	t.Setenv("P4U_CHANGELIST", strconv.Itoa(changelist))
+
+	exitCode, _ := app(context.Background(), slowFstatRunner{runner})
+	if exitCode != p4ExitSuccess || !strings.Contains(captured.String(), "success") {
+		t.Errorf("exit code %d, want %d\n%s", exitCode, p4ExitSuccess, captured)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// check_opened_files looks at pending changelists - which is all of them, as a trigger sees them - unless
+// p4unity is being run by hand
+
+func TestApp_CheckOpenedFiles(t *testing.T) {
+
+	for _, tc := range []struct {
+		name      string
+		runByHand bool
+		warnings  int
+	}{
+		{"trigger", false, 1},
+		{"by hand", true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestConfig(t)
+			AppConfig.CheckOpenedFiles = true
+			runByHand = tc.runByHand
+
+			observedCore, observedLogs := observer.New(zapcore.WarnLevel)
+			zLog = zap.New(observedCore)
+
+			runner, changelist := testdataRunner(t, "clean")
+			editDescribe(t, runner, changelist, map[string]string{"status": "pending"})
+			runner.Responses["opened "+strconv.Itoa(changelist)] = []byte("info: //Depot/UnityProjects/Thing/Assets/Textures/Rock.png#1 - add change 9148 (binary)\nexit: 0\n")
+			t.Setenv("P4U_CHANGELIST", strconv.Itoa(changelist))
+
+			if exitCode, _ := app(context.Background(), runner); exitCode != p4ExitSuccess {
+				t.Errorf("exit code %d, want %d", exitCode, p4ExitSuccess)
+			}
+			if warnings := observedLogs.FilterMessage("Opened").Len(); warnings != tc.warnings {
+				t.Errorf("%d Opened warnings, want %d", warnings, tc.warnings)
+			}
+		})
+	}
+}
+
+func TestApp_RestoresLogger(t *testing.T) {
+	useTestConfig(t)
+
+	observedCore, observedLogs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(observedCore)
+	zLog = logger
+
+	runner, changelist := testdataRunner(t, "clean")
+	t.Setenv("P4U_CHANGELIST", strconv.Itoa(changelist))
+
+	for run := 0; run < 2; run++ {
+		app(context.Background(), runner)
+		if zLog != logger {
+			t.Fatalf("run %d left zLog rebound", run)
+		}
+	}
+
+	// each run's Timings carries the changelist fields once, not once per earlier run
+	for _, entry := range observedLogs.FilterMessage("Timings").All() {
+		fields := 0
+		for _, field := range entry.Context {
+			if field.Key == "changelist" {
+				fields++
+			}
+		}
+		if fields != 1 {
+			t.Errorf("Timings logged with %d changelist fields, want 1", fields)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// p4 -G writes each record as a python marshal'd dictionary; unlike the -s text output there's no way for the
+// content of a field (eg. a changelist description) to be mistaken for the structure around it. p4 only ever
+// writes a handful of marshal types, so this reads just those - enough for flat dictionaries of strings and ints
+const (
+	marshalDict     = '{'
+	marshalDictEnd  = '0'
+	marshalString   = 's'
+	marshalUnicode  = 'u'
+	marshalInterned = 't'
+	marshalInt      = 'i'
+	marshalNone     = 'N'
+	marshalTrue     = 'T'
+	marshalFalse    = 'F'
+
+	// newer python versions flag objects that may be referenced later; p4 doesn't, but it costs nothing to ignore
+	marshalFlagRef = 0x80
+)
+
+// parseMarshalOutput decodes the output of a p4 command run with -G into one map per record, with every value
+// turned into a string so the records look the same as those from parseZtagOutput
+func parseMarshalOutput(out []byte) ([]map[string]string, error) {
+
+	records := make([]map[string]string, 0)
+	for offset := 0; offset < len(out); {
+
+		if out[offset]&^marshalFlagRef != marshalDict {
+			return nil, fmt.Errorf("expected a dictionary at byte %d, found %q", offset, out[offset])
+		}
+		offset++
+
+		record := make(map[string]string)
+		for {
+			if offset >= len(out) {
+				return nil, fmt.Errorf("dictionary not terminated")
+			}
+			if out[offset] == marshalDictEnd {
+				offset++
+				break
+			}
+
+			key, next, err := readMarshalValue(out, offset)
+			if err != nil {
+				return nil, err
+			}
+			value, next, err := readMarshalValue(out, next)
+			if err != nil {
+				return nil, err
+			}
+			record[key] = value
+			offset = next
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// readMarshalValue reads the single (non-container) value at <offset>, returning it as a string along with the
+// offset of whatever follows it
+func readMarshalValue(out []byte, offset int) (string, int, error) {
+
+	if offset >= len(out) {
+		return "", offset, fmt.Errorf("value missing at byte %d", offset)
+	}
+	valueType := out[offset] &^ marshalFlagRef
+	offset++
+
+	switch valueType {
+	case marshalString, marshalUnicode, marshalInterned:
+		if offset+4 > len(out) {
+			return "", offset, fmt.Errorf("string length truncated at byte %d", offset)
+		}
+		length := int(binary.LittleEndian.Uint32(out[offset:]))
+		offset += 4
+		if offset+length > len(out) {
+			return "", offset, fmt.Errorf("string truncated at byte %d", offset)
+		}
+		return string(out[offset : offset+length]), offset + length, nil
+
+	case marshalInt:
+		if offset+4 > len(out) {
+			return "", offset, fmt.Errorf("int truncated at byte %d", offset)
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(out[offset:])))), offset + 4, nil
+
+	case marshalNone:
+		return "", offset, nil
+	case marshalTrue:
+		return "true", offset, nil
+	case marshalFalse:
+		return "false", offset, nil
+	}
+	return "", offset, fmt.Errorf("unsupported marshal type %q at byte %d", valueType, offset-1)
+}
@@ -0,0 +1,124 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// MockP4Runner answers p4unity's queries from memory, for driving app() from go code rather than a server.
+// responses are keyed by query and argument, eg. "describe 9148", "fstat //Depot/Thing/Rock.png.meta@9148" or
+// "info", and hold exactly what p4 would have printed; marshalRecords helps build a -G describe. anything not
+// listed gets empty output, which for fstat means the file isn't in the depot
+type MockP4Runner struct {
+	Responses map[string][]byte
+}
+
+// Describe returns the response for "describe <changelist>"
+func (r MockP4Runner) Describe(ctx context.Context, changelist int) ([]byte, error) {
+	return r.Responses[fmt.Sprintf("describe %d", changelist)], nil
+}
+
+// Fstat returns the responses for "fstat <spec>" of each spec, one after the other as a batched fstat would
+func (r MockP4Runner) Fstat(ctx context.Context, fileSpecs []string, fields string) ([]byte, error) {
+	var out bytes.Buffer
+	for _, fileSpec := range fileSpecs {
+		out.Write(r.Responses["fstat "+fileSpec])
+	}
+	return out.Bytes(), nil
+}
+
+// FileSize returns the response for "filesize <spec>"
+func (r MockP4Runner) FileSize(ctx context.Context, fileSpec string) ([]byte, error) {
+	return r.Responses["filesize "+fileSpec], nil
+}
+
+// Print returns the response for "print <spec>"
+func (r MockP4Runner) Print(ctx context.Context, fileSpec string) ([]byte, error) {
+	return r.Responses["print "+fileSpec], nil
+}
+
+// Dirs returns the response for "dirs <spec>"
+func (r MockP4Runner) Dirs(ctx context.Context, dirSpec string) ([]byte, error) {
+	return r.Responses["dirs "+dirSpec], nil
+}
+
+// Files returns the response for "files <spec>", or "files -e <spec>" when asking for <existing> files
+func (r MockP4Runner) Files(ctx context.Context, fileSpec string, existing bool) ([]byte, error) {
+	if existing {
+		return r.Responses["files -e "+fileSpec], nil
+	}
+	return r.Responses["files "+fileSpec], nil
+}
+
+// Opened returns the response for "opened <changelist>"
+func (r MockP4Runner) Opened(ctx context.Context, changelist int) ([]byte, error) {
+	return r.Responses[fmt.Sprintf("opened %d", changelist)], nil
+}
+
+// Groups returns the response for "groups <user>"
+func (r MockP4Runner) Groups(ctx context.Context, user string) ([]byte, error) {
+	return r.Responses["groups "+user], nil
+}
+
+// Counter returns the response for "counter <name>", or 0 for a counter never set, as p4 does
+func (r MockP4Runner) Counter(ctx context.Context, name string) ([]byte, error) {
+	if value, ok := r.Responses["counter "+name]; ok {
+		return value, nil
+	}
+	return []byte("0\n"), nil
+}
+
+// SetCounter stores <value> as the response for "counter <name>"
+func (r MockP4Runner) SetCounter(ctx context.Context, name string, value int) ([]byte, error) {
+	r.Responses["counter "+name] = []byte(strconv.Itoa(value) + "\n")
+	return []byte{}, nil
+}
+
+// Info returns the response for "info"
+func (r MockP4Runner) Info(ctx context.Context) ([]byte, error) {
+	return r.Responses["info"], nil
+}
+
+// Login returns the response for "login"
+func (r MockP4Runner) Login(ctx context.Context) ([]byte, error) {
+	return r.Responses["login"], nil
+}
+
+// marshalRecords writes records the way p4 -G does; the reverse of parseMarshalOutput
+func marshalRecords(records []map[string]string) []byte {
+
+	var out bytes.Buffer
+	writeString := func(value string) {
+		out.WriteByte(marshalString)
+		binary.Write(&out, binary.LittleEndian, uint32(len(value)))
+		out.WriteString(value)
+	}
+
+	for _, record := range records {
+		keys := make([]string, 0, len(record))
+		for key := range record {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		out.WriteByte(marshalDict)
+		for _, key := range keys {
+			writeString(key)
+			writeString(record[key])
+		}
+		out.WriteByte(marshalDictEnd)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,102 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// snap a 'p4 files' record, eg. "//Depot/Thing/Assets/Rock.png#3 - edit change 1234 (binary+l)", into its path
+var reFilesRecordUnpack = regexp.MustCompile(`^(.+)#\d+ - \S+ change \d+`)
+
+// ----------------------------------------------------------------------------------------------------------
+// listOrphans backs `p4unity list-orphans <depot path>`; an audit of what's already in the depot, rather than a
+// changelist. every file under the path goes through the same filters as a submit would, then any asset without
+// its .meta (or .meta without its asset) is listed. nothing is blocked, so this always exits 0 once it has run
+func listOrphans(ctx context.Context, runner P4Runner, depotPath string) int {
+
+	if depotPath == "" {
+		fmt.Fprintf(output, "usage: p4unity [-config <path>] list-orphans <depot path>\n\n")
+		return p4ExitErrorUsage
+	}
+	depotPath = normalizePath(strings.TrimSuffix(depotPath, "/...")) + "/..."
+
+	// -e leaves out anything whose head revision is a delete
+	filesOut, err := runner.Files(ctx, depotPath, true)
+	if err != nil {
+		errMsg("failed to launch P4; %s\n%s\n\n", err, filesOut)
+		return p4FailureExit(ctx, p4ExitErrorException)
+	}
+
+	// the *IgnoringCase set mirrors its counterpart with lowered paths, as in app()
+	filesInDepot := make(stringSet)
+	filesInDepotIgnoringCase := make(stringSet)
+
+	for _, record := range filterStringsByType(splitP4Lines(filesOut), "info:") {
+
+		matches := reFilesRecordUnpack.FindStringSubmatch(record)
+		if len(matches) != 2 {
+			zLog.Warn("Orphans", zap.String("unparsed", record))
+			continue
+		}
+
+		filePath := matches[1]
+		itemDirectory, itemFilename := filepath.Split(filePath)
+		itemDirectory = normalizePath(itemDirectory) + "/"
+
+		if !shouldValidateFile(itemDirectory, itemFilename, zLog.With(zap.String("original-spec", record))) {
+			continue
+		}
+
+		filesInDepot.add(filePath)
+		if !AppConfig.CaseSensitiveDepot {
+			filesInDepotIgnoringCase.add(strings.ToLower(filePath))
+		}
+	}
+
+	sortedFiles := make([]string, 0, len(filesInDepot))
+	for file := range filesInDepot {
+		sortedFiles = append(sortedFiles, file)
+	}
+	sort.Strings(sortedFiles)
+
+	problemsFound := 0
+	for _, file := range sortedFiles {
+
+		twin := metaTwinPath(file)
+
+		// directory .meta; there's no depot entry for a directory to compare against
+		if twin == "" {
+			continue
+		}
+		if filepath.Ext(file) != ".meta" && !assetRequiresMeta(file) {
+			continue
+		}
+		if filesInDepot.has(twin) || filesInDepotIgnoringCase.has(strings.ToLower(twin)) {
+			continue
+		}
+
+		if filepath.Ext(file) != ".meta" {
+			fmt.Fprintf(output, "Missing .meta file for '%s'\n", file)
+		} else {
+			fmt.Fprintf(output, "Orphaned .meta file '%s' has no asset\n", file)
+		}
+		problemsFound++
+	}
+
+	zLog.Info("Orphans", zap.String("path", depotPath), zap.Int("filesChecked", len(sortedFiles)), zap.Int("problemsFound", problemsFound))
+	errMsg("checked %d files: %d problems found\n", len(sortedFiles), problemsFound)
+	return p4ExitSuccess
+}
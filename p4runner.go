@@ -0,0 +1,125 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"context"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// P4Runner is every p4 query p4unity makes, described by what they ask rather than how; RealP4Runner puts them to
+// the server, and tests hand app() (and friends) one that answers from memory instead. either way the output is
+// what p4 itself would have printed, so it goes through the same parsing
+type P4Runner interface {
+	// Describe returns the describe record for a changelist; python marshal'd (-G), or -ztag with use_ztag_output
+	Describe(ctx context.Context, changelist int) ([]byte, error)
+	// Fstat returns fstat records for a batch of file specs, limited to <fields> (-T) unless that's empty
+	Fstat(ctx context.Context, fileSpecs []string, fields string) ([]byte, error)
+	// FileSize returns the fstat record of a single file spec, including its fileSize
+	FileSize(ctx context.Context, fileSpec string) ([]byte, error)
+	// Print returns the content of a file spec
+	Print(ctx context.Context, fileSpec string) ([]byte, error)
+	// Dirs lists the depot directories matching a spec
+	Dirs(ctx context.Context, dirSpec string) ([]byte, error)
+	// Files lists the files matching a spec, eg. "@label"; with <existing>, not those whose head revision is a delete
+	Files(ctx context.Context, fileSpec string, existing bool) ([]byte, error)
+	// Opened lists the files still open in a changelist
+	Opened(ctx context.Context, changelist int) ([]byte, error)
+	// Groups lists the groups a user belongs to
+	Groups(ctx context.Context, user string) ([]byte, error)
+	// Counter returns the value of a counter
+	Counter(ctx context.Context, name string) ([]byte, error)
+	// SetCounter sets a counter to <value>
+	SetCounter(ctx context.Context, name string, value int) ([]byte, error)
+	// Info returns what the server says about itself; asked just the once, as it's how an unreachable server is found
+	Info(ctx context.Context) ([]byte, error)
+	// Login reports whether the configured credentials are good, without ever prompting
+	Login(ctx context.Context) ([]byte, error)
+}
+
+// RealP4Runner runs each query as a p4 command, with the connection, credentials and retries from the config
+type RealP4Runner struct{}
+
+// Describe runs 'p4 describe -s'
+func (RealP4Runner) Describe(ctx context.Context, changelist int) ([]byte, error) {
+
+	describeFlag := "-G"
+	if AppConfig.UseZtagOutput {
+		describeFlag = "-ztag"
+	}
+	return runP4(ctx, p4Command(ctx,
+		describeFlag,
+		"describe",
+		"-s",
+		strconv.Itoa(changelist),
+	))
+}
+
+// Fstat runs 'p4 fstat' over every one of <fileSpecs> at once
+func (RealP4Runner) Fstat(ctx context.Context, fileSpecs []string, fields string) ([]byte, error) {
+
+	fstatArgs := []string{p4OutputFlag(), "fstat"}
+	if fields != "" {
+		fstatArgs = append(fstatArgs, "-T", fields)
+	}
+	return runP4(ctx, p4Command(ctx, append(fstatArgs, fileSpecs...)...))
+}
+
+// FileSize runs 'p4 fstat -Ol'
+func (RealP4Runner) FileSize(ctx context.Context, fileSpec string) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "-s", "fstat", "-Ol", fileSpec))
+}
+
+// Print runs 'p4 print -q'
+func (RealP4Runner) Print(ctx context.Context, fileSpec string) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "print", "-q", fileSpec))
+}
+
+// Dirs runs 'p4 dirs'
+func (RealP4Runner) Dirs(ctx context.Context, dirSpec string) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "-s", "dirs", dirSpec))
+}
+
+// Files runs 'p4 files', with -e for <existing>
+func (RealP4Runner) Files(ctx context.Context, fileSpec string, existing bool) ([]byte, error) {
+	if existing {
+		return runP4(ctx, p4Command(ctx, "-s", "files", "-e", fileSpec))
+	}
+	return runP4(ctx, p4Command(ctx, "-s", "files", fileSpec))
+}
+
+// Opened runs 'p4 opened -c'
+func (RealP4Runner) Opened(ctx context.Context, changelist int) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "-s", "opened", "-c", strconv.Itoa(changelist)))
+}
+
+// Groups runs 'p4 groups -u'
+func (RealP4Runner) Groups(ctx context.Context, user string) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "-s", "groups", "-u", user))
+}
+
+// Counter runs 'p4 counter -u'
+func (RealP4Runner) Counter(ctx context.Context, name string) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "counter", "-u", name))
+}
+
+// SetCounter runs 'p4 counter -u' with a value
+func (RealP4Runner) SetCounter(ctx context.Context, name string, value int) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "counter", "-u", name, strconv.Itoa(value)))
+}
+
+// Info runs 'p4 info', without any retries
+func (RealP4Runner) Info(ctx context.Context) ([]byte, error) {
+	return p4Command(ctx, "-s", "info").CombinedOutput()
+}
+
+// Login runs 'p4 login -s'
+func (RealP4Runner) Login(ctx context.Context) ([]byte, error) {
+	return runP4(ctx, p4Command(ctx, "-s", "login", "-s"))
+}
@@ -0,0 +1,362 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// output is where every user-facing message is written; stdout, and optionally a file too (see initOutput)
+var output io.Writer = os.Stdout
+
+// initOutput tees output into AppConfig.OutputFile, if set, as an audit trail in case p4d loses what the trigger
+// printed; the file is appended to, never truncated. returns the file for the caller to close, or nil
+func initOutput() *os.File {
+
+	if AppConfig.OutputFile == "" {
+		return nil
+	}
+
+	outputFile, err := os.OpenFile(AppConfig.OutputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s could not open output file '%s'; %s\n", AppConfig.ErrorPrefix, AppConfig.OutputFile, err)
+		return nil
+	}
+
+	output = io.MultiWriter(os.Stdout, outputFile)
+	return outputFile
+}
+
+// ValidationProblem is a single issue found with a changelist, eg. an asset missing its .meta
+type ValidationProblem struct {
+	File    string `json:"file"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// AppReport is the outcome of app(), beyond its exit code; ProblemsFound holds the message for each problem
+// reported (up to max_validation_errors), and WarnOnly is set when those problems were let through by warn_only.
+// the changelist, user and client are filled in as they become known
+type AppReport struct {
+	Changelist    int
+	User          string
+	Client        string
+	ProblemsFound []string
+	FilesChecked  int
+	Bypassed      bool
+	WarnOnly      bool
+}
+
+// kinds of problem that can be reported
+const (
+	problemMissingMeta      = "missing-meta"
+	problemMissingAsset     = "missing-asset"
+	problemMissingDirectory = "missing-directory"
+	problemOrphanedMeta     = "orphaned-meta"
+	problemOrphanedAsset    = "orphaned-asset"
+	problemEditMissingMeta  = "edit-missing-meta"
+	problemInvalidGUID      = "invalid-guid"
+	problemEmptyMeta        = "empty-meta"
+	problemGUIDChanged      = "guid-changed"
+	problemMoveMissingMeta  = "move-missing-meta"
+	problemMoveMissingAsset = "move-missing-asset"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// problemList gathers up everything wrong with a changelist; in the default text mode each problem is
+// also printed as it is found, which p4 relays back to the user. once the configured maximum is reached
+// anything further is dropped and the list is marked as suppressed, so the checks can stop early; report returns
+// false for a dropped problem, so the summary counts what was listed
+//
+// submitter, if known, is prepended to each printed problem (eg. "Change 9148 by harry@harry_pc") so a rejection
+// email makes sense on its own; likewise any description lines are printed ahead of the first problem, so the
+// developer can tell which of their changes was rejected
+//
+// problems with files under a package folder go to warnings instead, when packages_warn_only is set; they're
+// printed but never block, and report returns false for them so the caller knows not to count them
+type problemList struct {
+	items       []ValidationProblem
+	warnings    []ValidationProblem
+	suppressed  bool
+	submitter   string
+	description []string
+}
+
+func (p *problemList) report(file string, kind string, message string) bool {
+
+	if AppConfig.PackagesWarnOnly && pathIsInPackages(file) {
+		p.warnings = append(p.warnings, ValidationProblem{
+			File:    file,
+			Kind:    kind,
+			Message: message,
+		})
+		zLog.Warn("Problem-Package", zap.String("file", file), zap.String("kind", kind))
+
+		if !AppConfig.JSONOutput && !markdownOutput() {
+			line := message
+			if p.submitter != "" {
+				line = p.submitter + ": " + message
+			}
+			fmt.Fprintf(output, "%s[WARN] %s\n", AppConfig.ErrorPrefix, line)
+		}
+		return false
+	}
+
+	if AppConfig.MaxValidationErrors > 0 && len(p.items) >= AppConfig.MaxValidationErrors {
+		if !p.suppressed {
+			zLog.Info("Problem-Limit", zap.Int("max", AppConfig.MaxValidationErrors))
+		}
+		p.suppressed = true
+		return false
+	}
+
+	p.items = append(p.items, ValidationProblem{
+		File:    file,
+		Kind:    kind,
+		Message: message,
+	})
+	zLog.Info("Problem", zap.String("file", file), zap.String("kind", kind))
+
+	if !AppConfig.JSONOutput && !markdownOutput() {
+		if dryRun && len(p.items) == 1 {
+			errMsg("DRY-RUN: problems found but commit allowed\n")
+		}
+		if len(p.description) > 0 && len(p.items) == 1 {
+			for _, line := range p.description {
+				fmt.Fprintf(output, "    %s\n", line)
+			}
+			fmt.Fprintln(output)
+		}
+		line := message
+		if p.submitter != "" {
+			line = p.submitter + ": " + message
+		}
+		if AppConfig.WarnOnly {
+			fmt.Fprintf(output, "%s[WARN] %s\n", AppConfig.ErrorPrefix, line)
+		} else if p.submitter != "" {
+			errMsg("%s\n", line)
+		} else {
+			fmt.Fprintln(output, line)
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// errMsg prints a user-facing message, prefixed to identify where it came from; "[p4unity]" unless the
+// config has rebranded it
+func errMsg(format string, args ...interface{}) {
+	fmt.Fprintf(output, AppConfig.ErrorPrefix+" "+format, args...)
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// printBypassed lets the user know validation was skipped
+func printBypassed() {
+	if AppConfig.JSONOutput {
+		printJSONReport(true, problemList{})
+	} else {
+		errMsg("bypassing validation\n\n")
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// jsonReport is the single document emitted in JSON output mode
+type jsonReport struct {
+	OK       bool                `json:"ok"`
+	Problems []ValidationProblem `json:"problems"`
+	Warnings []ValidationProblem `json:"warnings,omitempty"`
+}
+
+func printJSONReport(ok bool, problems problemList) {
+
+	items := problems.items
+	if items == nil {
+		items = []ValidationProblem{}
+	}
+
+	reportBytes, err := json.Marshal(jsonReport{
+		OK:       ok,
+		Problems: items,
+		Warnings: problems.warnings,
+	})
+	if err != nil {
+		errMsg("could not encode report; %s\n", err)
+		return
+	}
+	fmt.Fprintln(output, string(reportBytes))
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// markdownOutput is true when a rejection should be written as markdown, for review tools (Swarm, TeamHub ..)
+// that render it; json_output takes precedence if both are set
+func markdownOutput() bool {
+	return AppConfig.MarkdownOutput && !AppConfig.JSONOutput
+}
+
+// printMarkdownReport writes the problems found as a single markdown document, in place of the plain text
+// lines; the changelist description goes in a fenced block so nothing in it is rendered
+func printMarkdownReport(problems problemList, filesChecked int, problemsFound int) {
+
+	var markdown strings.Builder
+	markdown.WriteString("## p4unity Validation Report\n\n")
+
+	if problems.submitter != "" {
+		fmt.Fprintf(&markdown, "**%s**\n\n", problems.submitter)
+	}
+	if len(problems.description) > 0 {
+		markdown.WriteString("```\n")
+		for _, line := range problems.description {
+			fmt.Fprintf(&markdown, "%s\n", line)
+		}
+		markdown.WriteString("```\n\n")
+	}
+
+	switch {
+	case dryRun:
+		markdown.WriteString("_dry run: problems found but commit allowed_\n\n")
+	case AppConfig.WarnOnly:
+		markdown.WriteString("_warning only: commit allowed_\n\n")
+	}
+
+	for _, problem := range problems.items {
+		fmt.Fprintf(&markdown, "* %s\n", problem.Message)
+	}
+	if problems.suppressed {
+		markdown.WriteString("* ... and more errors were suppressed\n")
+	}
+	for _, warning := range problems.warnings {
+		fmt.Fprintf(&markdown, "* _warning:_ %s\n", warning.Message)
+	}
+
+	fmt.Fprintf(&markdown, "\nchecked %d files: %d problems found\n", filesChecked, problemsFound)
+	fmt.Fprint(output, markdown.String())
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// JUnit XML, for CI systems that render test results; a changelist is a suite and each validated file is a case
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Failures  []junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnitReport(reportPath string, changelist int, filesValidated stringSet, problems problemList) error {
+
+	// problems are keyed back to their file; include any file that had a problem, in case it wasn't already listed
+	failuresByFile := make(map[string][]junitFailure)
+	caseFiles := make(stringSet)
+	for file := range filesValidated {
+		caseFiles.add(file)
+	}
+	for _, problem := range problems.items {
+		failuresByFile[problem.File] = append(failuresByFile[problem.File], junitFailure{
+			Type:    problem.Kind,
+			Message: problem.Message,
+			Text:    problem.Message,
+		})
+		caseFiles.add(problem.File)
+	}
+
+	sortedFiles := make([]string, 0, len(caseFiles))
+	for file := range caseFiles {
+		sortedFiles = append(sortedFiles, file)
+	}
+	sort.Strings(sortedFiles)
+
+	suite := junitTestSuite{
+		Name:  fmt.Sprintf("p4unity.changelist.%d", changelist),
+		Tests: len(sortedFiles),
+	}
+	for _, file := range sortedFiles {
+		failures := failuresByFile[file]
+		if len(failures) > 0 {
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Name:      file,
+			ClassName: suite.Name,
+			Failures:  failures,
+		})
+	}
+
+	reportBytes, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reportPath, append([]byte(xml.Header), reportBytes...), 0644)
+}
+
+// ----------------------------------------------------------------------------------------------------------
+// webhookReport is POSTed to AppConfig.ReportWebhookURL once a changelist has been validated, for CI systems
+// that would rather be told than parse rejection emails
+type webhookReport struct {
+	Changelist int                 `json:"changelist"`
+	User       string              `json:"user"`
+	Client     string              `json:"client"`
+	Allowed    bool                `json:"allowed"`
+	Problems   []ValidationProblem `json:"problems"`
+}
+
+func postWebhookReport(webhookURL string, report webhookReport) error {
+
+	if report.Problems == nil {
+		report.Problems = []ValidationProblem{}
+	}
+
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: time.Duration(AppConfig.WebhookTimeoutSeconds) * time.Second}
+	response, err := client.Post(webhookURL, "application/json", bytes.NewReader(reportBytes))
+	if err != nil {
+		// the url is as much a secret as a password, for most webhooks; keep it out of the error
+		if urlErr, ok := err.(*url.Error); ok {
+			return fmt.Errorf("%s failed; %s", urlErr.Op, urlErr.Err)
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+/* p4unity
+ * `change-content` handler for Perforce Helix to guard against
+ * bad behaviour with Unity projects' .meta files
+ *
+ * harry denholm, 2020; ishani.org
+ */
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------------------------------------
+// once max_validation_errors is reached, problems are dropped, and aren't counted
+
+func TestProblemList_MaxValidationErrors(t *testing.T) {
+	useTestConfig(t)
+	AppConfig.MaxValidationErrors = 2
+
+	var problems problemList
+	counted := 0
+	for i := 0; i < 4; i++ {
+		file := fmt.Sprintf("//Depot/UnityProjects/Thing/Assets/Rock%d.png", i)
+		if problems.report(file, problemMissingMeta, "Missing .meta file for '"+file+"'") {
+			counted++
+		}
+	}
+
+	if counted != 2 || len(problems.items) != 2 || !problems.suppressed {
+		t.Errorf("counted %d, listed %d, suppressed %v", counted, len(problems.items), problems.suppressed)
+	}
+}
+
+func TestApp_MaxValidationErrorsSummary(t *testing.T) {
+	captured := useTestConfig(t)
+	AppConfig.MaxValidationErrors = 1
+
+	// missing-meta with a second asset missing its .meta, so one of the two is suppressed
+	runner, changelist := testdataRunner(t, "missing-meta")
+	editDescribe(t, runner, changelist, map[string]string{
+		"depotFile3": "//Depot/UnityProjects/Thing/Assets/Textures/Stone.png",
+		"action3":    "add",
+		"type3":      "binary",
+		"rev3":       "1",
+	})
+	t.Setenv("P4U_CHANGELIST", strconv.Itoa(changelist))
+
+	exitCode, report := app(context.Background(), runner)
+	if exitCode != p4ExitProblems {
+		t.Errorf("exit code %d, want %d\n%s", exitCode, p4ExitProblems, captured)
+	}
+	if len(report.ProblemsFound) != 1 || !strings.Contains(captured.String(), "1 problems found") {
+		t.Errorf("summary doesn't match the %d problems listed\n%s", len(report.ProblemsFound), captured)
+	}
+}